@@ -0,0 +1,131 @@
+package db
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The classes a bounce can be in
+const (
+	// BounceHard means the address doesn't exist or can't receive email, so
+	// sending to it again will fail too
+	BounceHard = "hard"
+
+	// BounceSoft means the email couldn't be delivered right now, such as when
+	// the mailbox is full or the server is unavailable
+	BounceSoft = "soft"
+
+	// BounceBlock means the receiving server refused the email because of its
+	// content or the sender's reputation, not because of the address
+	BounceBlock = "block"
+)
+
+// Bounce is the classification of a bounce or drop parsed out of the reason
+// the provider sent us
+type Bounce struct {
+	// Class is one of hard, soft or block
+	Class string `json:"class" bson:"c"`
+
+	// Code is the SMTP reply code, such as 550, if there was one
+	Code int `json:"code,omitempty" bson:"code,omitempty"`
+
+	// Status is the enhanced status code, such as 5.1.1, if there was one
+	Status string `json:"status,omitempty" bson:"st,omitempty"`
+}
+
+// bounceClassFields are the fields in EmailDoc holding the times of the
+// bounces in each class
+var bounceClassFields = map[string]string{
+	BounceHard:  "hb",
+	BounceSoft:  "sb",
+	BounceBlock: "bk",
+}
+
+var (
+	// codes have to stand on their own, at the start of the reason or after a
+	// separator, so numbers like the octets of IPs in the reason aren't
+	// mistaken for them. SMTP codes are followed by a space or a dash, which
+	// is used in multiline replies
+	smtpCodeRegex     = regexp.MustCompile(`(?:^|[\s;:(\[])([245][0-9][0-9])(?:[\s-]|$)`)
+	enhancedCodeRegex = regexp.MustCompile(`(?:^|[\s;:(\[-])([245])\.([0-9]{1,3})\.([0-9]{1,3})(?:[^.0-9]|$)`)
+
+	// blockPhrases are found in the reasons of bounces caused by the sender's
+	// reputation or the content of the email
+	blockPhrases = []string{
+		"blocked", "blacklist", "blocklist", "spamhaus", "rbl", "reputation",
+		"spam", "policy",
+	}
+
+	// notBouncePhrases are found in the reasons of drops which have nothing
+	// to do with the address being deliverable
+	notBouncePhrases = []string{
+		"unsubscribed address", "spam reporting address", "invalid smtpapi header",
+	}
+
+	// hardPhrases are found in the reasons of bounces and drops caused by the
+	// address not existing
+	hardPhrases = []string{
+		"bounced address", "invalid", "does not exist", "user unknown",
+		"unknown user", "no such user", "mailbox unavailable",
+	}
+)
+
+// classifyBounce parses the SMTP reply code and enhanced status code out of
+// the reason and uses them to classify it. bounceType is the type SendGrid
+// sends with bounce events, which is either bounce or blocked. If the bounce
+// can't be classified then nil is returned
+func classifyBounce(reason, bounceType string) *Bounce {
+	b := &Bounce{}
+	if m := smtpCodeRegex.FindStringSubmatch(reason); m != nil {
+		b.Code, _ = strconv.Atoi(m[1])
+	}
+	var subject, detail string
+	if m := enhancedCodeRegex.FindStringSubmatch(reason); m != nil {
+		subject, detail = m[2], m[3]
+		b.Status = m[1] + "." + subject + "." + detail
+	}
+	lower := strings.ToLower(reason)
+	if containsAny(lower, notBouncePhrases) {
+		return nil
+	}
+
+	// X.1.X and X.2.X are problems with the address or mailbox, which the
+	// phrases could only get wrong, like when the reason links to a policy
+	addressStatus := subject == "1" || subject == "2"
+
+	switch {
+	case !addressStatus && (bounceType == "blocked" || subject == "7" || containsAny(lower, blockPhrases)):
+		// X.7.X are security or policy failures
+		b.Class = BounceBlock
+	case b.Status != "":
+		switch {
+		case b.Status[0] == '4':
+			b.Class = BounceSoft
+		// 5.2.2 is a full mailbox and X.3.X and X.4.X are problems with the
+		// receiving system or network, which can all go away on their own
+		case subject == "2" && detail == "2", subject == "3", subject == "4":
+			b.Class = BounceSoft
+		default:
+			b.Class = BounceHard
+		}
+	case b.Code >= 500:
+		b.Class = BounceHard
+	case b.Code >= 400:
+		b.Class = BounceSoft
+	case containsAny(lower, hardPhrases):
+		b.Class = BounceHard
+	default:
+		return nil
+	}
+	return b
+}
+
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
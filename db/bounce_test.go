@@ -0,0 +1,45 @@
+package db
+
+import (
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyBounce(t *T) {
+	tests := []struct {
+		reason, bounceType string
+		b                  *Bounce
+	}{
+		{"550 5.1.1 The email account that you tried to reach does not exist", "bounce",
+			&Bounce{Class: BounceHard, Code: 550, Status: "5.1.1"}},
+		{"552 5.2.2 The email account that you tried to reach is over quota", "bounce",
+			&Bounce{Class: BounceSoft, Code: 552, Status: "5.2.2"}},
+		{"421 4.2.2 Mailbox full", "",
+			&Bounce{Class: BounceSoft, Code: 421, Status: "4.2.2"}},
+		{"554 5.7.1 Service unavailable; Client host blocked using zen.spamhaus.org", "bounce",
+			&Bounce{Class: BounceBlock, Code: 554, Status: "5.7.1"}},
+		{"550 Message rejected", "blocked",
+			&Bounce{Class: BounceBlock, Code: 550}},
+		{"550 Requested action not taken", "",
+			&Bounce{Class: BounceHard, Code: 550}},
+		{"451 Temporary local problem", "",
+			&Bounce{Class: BounceSoft, Code: 451}},
+		{"550 5.1.1 No such user, see https://mail.example.com/policy", "bounce",
+			&Bounce{Class: BounceHard, Code: 550, Status: "5.1.1"}},
+		{"smtp; 550-5.1.1 user unknown", "bounce",
+			&Bounce{Class: BounceHard, Code: 550, Status: "5.1.1"}},
+		{"Remote host 250.1.1.1 said: 421 Try again later", "",
+			&Bounce{Class: BounceSoft, Code: 421}},
+		{"Connection from 10.5.1.1 refused", "", nil},
+		{"Bounced Address", "", &Bounce{Class: BounceHard}},
+		{"Invalid", "", &Bounce{Class: BounceHard}},
+		{"Unsubscribed Address", "", nil},
+		{"Spam Reporting Address", "", nil},
+		{"Invalid SMTPAPI header", "", nil},
+		{"Test", "", nil},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.b, classifyBounce(test.reason, test.bounceType), test.reason)
+	}
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/levenlabs/postmaster/ga"
+	"github.com/levenlabs/postmaster/sender"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// frequencyCap limits how many emails sharing any of flags a recipient can be
+// sent within window
+type frequencyCap struct {
+	flags  int64
+	max    int
+	window time.Duration
+}
+
+// frequencyCaps are the caps from --frequency-caps
+var frequencyCaps []frequencyCap
+
+// The errors stored with emails which were suppressed
+const (
+	// SuppressedFrequencyCap is for emails which were over a frequency cap
+	SuppressedFrequencyCap = "over frequency cap"
+
+	// SuppressedPrefs is for emails whose flags were blocked by the
+	// recipient's prefs after they were enqueued
+	SuppressedPrefs = "blocked by prefs"
+)
+
+// expiredReason is the error stored with emails which expired before they
+// could be sent
+const expiredReason = "expired before it could be sent"
+
+// parseFrequencyCaps parses a spec in the form of flags:max/window,... such as
+// 4:3/168h
+func parseFrequencyCaps(spec string) ([]frequencyCap, error) {
+	cws, err := parseCountWindows(spec, "frequency cap")
+	if err != nil {
+		return nil, err
+	}
+	var caps []frequencyCap
+	for _, cw := range cws {
+		flags, err := strconv.ParseInt(cw.key, 10, 64)
+		if err != nil || flags <= 0 {
+			return nil, fmt.Errorf("invalid flags for frequency cap %q", cw.key)
+		}
+		caps = append(caps, frequencyCap{flags: flags, max: cw.count, window: cw.window})
+	}
+	return caps, nil
+}
+
+// OverFrequencyCap returns whether sending an email with flags to recipient
+// would go over any of the --frequency-caps. The emails already sent are
+// counted using their stats, so caps aren't enforced when mongo is disabled
+func OverFrequencyCap(recipient string, flags int64) (bool, error) {
+	if mongoDisabled {
+		return false, nil
+	}
+	now := time.Now()
+	for _, fc := range frequencyCaps {
+		if fc.flags&flags == 0 {
+			continue
+		}
+		var n int
+		var err error
+		statsSH.WithColl(func(c *mgo.Collection) {
+			n, err = c.Find(bson.M{
+				"r":  recipient,
+				"ef": bson.M{"$bitsAnySet": fc.flags},
+				// emails which weren't sent don't count
+				"s":  bson.M{"$bitsAllClear": unsentStates},
+				"tc": bson.M{"$gte": toTS(now.Add(-fc.window))},
+			}).Count()
+		})
+		if err != nil {
+			return false, err
+		} else if n >= fc.max {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SuppressEmail stores the stats of an email which isn't going to be sent,
+// with the Suppressed state and reason as its error, and returns its ID. The ID
+// assigned by AssignStatsID is used if there is one
+func SuppressEmail(job *sender.Mail, reason string) string {
+	return storeUnsent(job, Suppressed, reason)
+}
+
+// storeUnsent stores the stats of an email which isn't going to be sent with
+// the given state and reason as its error, and returns its ID
+func storeUnsent(job *sender.Mail, state int, reason string) string {
+	doc := &StatDoc{
+		Recipient:       job.To,
+		EmailFlags:      job.Flags,
+		StateFlags:      int64(state),
+		UniqueID:        job.UniqueID,
+		SentEnvironment: ga.Environment,
+		Error:           reason,
+	}
+	if sid := job.UniqueArgs[uniqueArgStatID]; bson.IsObjectIdHex(sid) {
+		doc.ID = bson.ObjectIdHex(sid)
+	}
+	return generateEmailID(doc)
+}
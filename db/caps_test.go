@@ -0,0 +1,71 @@
+package db
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/postmaster/sender"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFrequencyCaps(t *T) {
+	caps, err := parseFrequencyCaps("4:3/168h, 8:1/24h")
+	require.Nil(t, err)
+	assert.Equal(t, []frequencyCap{
+		{flags: 4, max: 3, window: 168 * time.Hour},
+		{flags: 8, max: 1, window: 24 * time.Hour},
+	}, caps)
+
+	for _, spec := range []string{"4", "4:3", "4/168h", "0:3/1h", "4:0/1h", "4:3/nope"} {
+		_, err = parseFrequencyCaps(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestOverFrequencyCap(t *T) {
+	require.False(t, mongoDisabled)
+	defer func(caps []frequencyCap) { frequencyCaps = caps }(frequencyCaps)
+	frequencyCaps = []frequencyCap{{flags: 4 | 8, max: 2, window: time.Hour}}
+	email := testutil.RandStr() + "@test.com"
+
+	over, err := OverFrequencyCap(email, 4)
+	require.Nil(t, err)
+	assert.False(t, over)
+
+	require.NotEmpty(t, GenerateEmailID(email, 4, "", "production"))
+	// emails with other flags don't count
+	require.NotEmpty(t, GenerateEmailID(email, 16, "", "production"))
+	over, err = OverFrequencyCap(email, 8)
+	require.Nil(t, err)
+	assert.False(t, over)
+
+	// neither do suppressed ones
+	job := &sender.Mail{To: email, Flags: 8}
+	id := SuppressEmail(job, SuppressedFrequencyCap)
+	require.NotEmpty(t, id)
+	doc, err := GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(Suppressed), doc.StateFlags)
+	assert.Equal(t, SuppressedFrequencyCap, doc.Error)
+	over, err = OverFrequencyCap(email, 8)
+	require.Nil(t, err)
+	assert.False(t, over)
+
+	// or expired ones
+	require.NotEmpty(t, storeUnsent(job, Expired, expiredReason))
+	over, err = OverFrequencyCap(email, 8)
+	require.Nil(t, err)
+	assert.False(t, over)
+
+	require.NotEmpty(t, GenerateEmailID(email, 8|16, "", "production"))
+	over, err = OverFrequencyCap(email, 4)
+	require.Nil(t, err)
+	assert.True(t, over)
+
+	// flags without a cap are never over
+	over, err = OverFrequencyCap(email, 16)
+	require.Nil(t, err)
+	assert.False(t, over)
+}
@@ -15,5 +15,15 @@ func init() {
 	emailSH.Coll = emailsColl
 	statsColl = fmt.Sprintf("records-%s", testutil.RandStr())
 	statsSH.Coll = statsColl
+	deferredColl = fmt.Sprintf("deferred-%s", testutil.RandStr())
+	deferredSH.Coll = deferredColl
+	idempotencyColl = fmt.Sprintf("idempotency-%s", testutil.RandStr())
+	idempotencySH.Coll = idempotencyColl
+	uniqueClaimsColl = fmt.Sprintf("uniqueclaims-%s", testutil.RandStr())
+	uniqueClaimsSH.Coll = uniqueClaimsColl
+	webhookEventsColl = fmt.Sprintf("webhookevents-%s", testutil.RandStr())
+	webhookEventsSH.Coll = webhookEventsColl
+	deadColl = fmt.Sprintf("dead-%s", testutil.RandStr())
+	deadSH.Coll = deadColl
 	ga.GA.TestMode()
 }
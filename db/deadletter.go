@@ -0,0 +1,151 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/mgoutil"
+	"github.com/levenlabs/golib/timeutil"
+	"github.com/levenlabs/postmaster/sender"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DeadLetter is a send job which was given up on, either because the provider
+// rejected it or because it ran out of attempts
+type DeadLetter struct {
+	ID bson.ObjectId `json:"id" bson:"_id"`
+
+	// Contents is the job as it was in the send queue
+	Contents string `json:"-" bson:"c"`
+
+	// Recipient is the email address of the recipient
+	Recipient string `json:"recipient" bson:"r"`
+
+	// Reason is the last error returned when sending
+	Reason string `json:"reason" bson:"err"`
+
+	// Attempts is how many times sending was attempted
+	Attempts int `json:"attempts" bson:"a"`
+
+	// TSCreated is when the job was given up on
+	TSCreated timeutil.Timestamp `json:"tsCreated" bson:"tc"`
+}
+
+var (
+	deadSH   mgoutil.SessionHelper
+	deadColl = "dead"
+
+	// ErrDeadLetterNotFound is returned when trying to replay a dead letter
+	// which doesn't exist
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// storeDeadLetter stores a send job which has been given up on
+func storeDeadLetter(jobContents, recipient, reason string, attempts int) error {
+	if mongoDisabled {
+		return MongoDisabledErr
+	}
+	doc := &DeadLetter{
+		ID:        bson.NewObjectId(),
+		Contents:  jobContents,
+		Recipient: recipient,
+		Reason:    reason,
+		Attempts:  attempts,
+		TSCreated: timeutil.TimestampNow(),
+	}
+	var err error
+	deadSH.WithColl(func(c *mgo.Collection) {
+		err = c.Insert(doc)
+	})
+	return err
+}
+
+// ListDeadLetters returns up to limit of the newest dead letters. If recipient
+// is set then only dead letters for that recipient are returned
+func ListDeadLetters(recipient string, limit int) ([]DeadLetter, error) {
+	if mongoDisabled {
+		return nil, MongoDisabledErr
+	}
+	q := bson.M{}
+	if recipient != "" {
+		q["r"] = recipient
+	}
+	docs := []DeadLetter{}
+	var err error
+	deadSH.WithColl(func(c *mgo.Collection) {
+		err = c.Find(q).Sort("-tc").Limit(limit).All(&docs)
+	})
+	return docs, err
+}
+
+// ReplayDeadLetter pushes the dead letter back into the send queue as if it had
+// just been enqueued, and removes it
+func ReplayDeadLetter(id string) error {
+	if mongoDisabled {
+		return MongoDisabledErr
+	}
+	if !bson.IsObjectIdHex(id) {
+		return ErrDeadLetterNotFound
+	}
+	doc := &DeadLetter{}
+	var err error
+	deadSH.WithColl(func(c *mgo.Collection) {
+		err = c.FindId(bson.ObjectIdHex(id)).One(doc)
+	})
+	if err == mgo.ErrNotFound {
+		return ErrDeadLetterNotFound
+	} else if err != nil {
+		return err
+	}
+
+	sj := new(sendJob)
+	if err = json.Unmarshal([]byte(doc.Contents), sj); err != nil {
+		return err
+	}
+	// it's a new attempt at the email so it gets a fresh set of attempts, but
+	// it keeps its statsID so it can still be tracked with the one Enqueue
+	// returned. The Failed stats are removed so they're stored again when it's
+	// sent
+	sj.Attempts = 0
+	contents, err := json.Marshal(sj)
+	if err != nil {
+		return err
+	}
+	if sid := sj.UniqueArgs[uniqueArgStatID]; bson.IsObjectIdHex(sid) {
+		if err = removeEmailID(sid); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	if err = StoreSendJob(string(contents), sender.PickPriority(&sj.Mail)); err != nil {
+		return err
+	}
+
+	deadSH.WithColl(func(c *mgo.Collection) {
+		err = c.RemoveId(doc.ID)
+	})
+	if err != nil {
+		// we don't want to return an error since it was already replayed
+		llog.Error("error removing replayed dead letter", llog.KV{"id": id}, llog.ErrKV(err))
+	}
+	return nil
+}
+
+// PurgeDeadLetters removes all dead letters that were created before the given
+// time and returns how many were removed
+func PurgeDeadLetters(before time.Time) (int, error) {
+	if mongoDisabled {
+		return 0, MongoDisabledErr
+	}
+	var info *mgo.ChangeInfo
+	var err error
+	deadSH.WithColl(func(c *mgo.Collection) {
+		info, err = c.RemoveAll(bson.M{"tc": bson.M{"$lt": toTS(before)}})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/postmaster/sender"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+)
+
+func TestDeadLetters(t *T) {
+	require.False(t, mongoDisabled)
+	to := fmt.Sprintf("%s@test.com", testutil.RandStr())
+	id := GenerateEmailID(to, 0, "", "production")
+	require.NotEmpty(t, id)
+	require.Nil(t, MarkAsFailed(id, "nope"))
+	sj := &sendJob{
+		Mail: sender.Mail{
+			To:         to,
+			UniqueArgs: map[string]string{uniqueArgStatID: id, "other": "arg"},
+		},
+		Attempts: 8,
+	}
+	contents, err := json.Marshal(sj)
+	require.Nil(t, err)
+	require.Nil(t, storeDeadLetter(string(contents), to, "nope", 8))
+
+	docs, err := ListDeadLetters(to, 10)
+	require.Nil(t, err)
+	require.Len(t, docs, 1)
+	assert.Equal(t, to, docs[0].Recipient)
+	assert.Equal(t, "nope", docs[0].Reason)
+	assert.Equal(t, 8, docs[0].Attempts)
+
+	// randomize the queue so the consumer doesn't pick up the replayed job
+	existingQueue := normalQueue
+	defer func() {
+		normalQueue = existingQueue
+	}()
+	normalQueue = testutil.RandStr()
+
+	require.Nil(t, ReplayDeadLetter(docs[0].ID.Hex()))
+	assert.Equal(t, ErrDeadLetterNotFound, ReplayDeadLetter(docs[0].ID.Hex()))
+	docs, err = ListDeadLetters(to, 10)
+	require.Nil(t, err)
+	assert.Len(t, docs, 0)
+
+	// the failed stats are removed so they're stored again when it's sent
+	_, err = GetStats(id)
+	assert.Equal(t, mgo.ErrNotFound, err)
+
+	r, err := redis.DialTimeout("tcp", okqAddr, 5*time.Second)
+	require.Nil(t, err)
+	res, err := r.Cmd("QRPOP", normalQueue, "EX", 0).Array()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(res))
+	cont, err := res[1].Str()
+	require.Nil(t, err)
+	replayed := new(sendJob)
+	require.Nil(t, json.Unmarshal([]byte(cont), replayed))
+	assert.Equal(t, 0, replayed.Attempts)
+	assert.Equal(t, map[string]string{uniqueArgStatID: id, "other": "arg"}, replayed.UniqueArgs)
+}
+
+func TestPurgeDeadLetters(t *T) {
+	require.False(t, mongoDisabled)
+	to := fmt.Sprintf("%s@test.com", testutil.RandStr())
+	require.Nil(t, storeDeadLetter("{}", to, "nope", 1))
+
+	_, err := PurgeDeadLetters(time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	docs, err := ListDeadLetters(to, 10)
+	require.Nil(t, err)
+	assert.Len(t, docs, 1)
+
+	n, err := PurgeDeadLetters(time.Now().Add(time.Second))
+	require.Nil(t, err)
+	assert.True(t, n >= 1)
+	docs, err = ListDeadLetters(to, 10)
+	require.Nil(t, err)
+	assert.Len(t, docs, 0)
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/mgoutil"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// deferredDoc is a job which is being held until At, when it's pushed into
+// Queue
+type deferredDoc struct {
+	ID       bson.ObjectId `bson:"_id"`
+	Queue    string        `bson:"q"`
+	Contents string        `bson:"c"`
+	At       time.Time     `bson:"at"`
+
+	// LockedUntil is set by the instance releasing the job so no other
+	// instance releases it too. If that instance dies before removing the job
+	// it'll be released again once this passes
+	LockedUntil time.Time `bson:"l"`
+}
+
+var (
+	deferredSH   mgoutil.SessionHelper
+	deferredColl = "deferred"
+
+	// deferPoll is how often we check for deferred jobs which are due
+	deferPoll = time.Second
+
+	// deferLock is how long a job is locked for while it's being released
+	deferLock = time.Minute
+
+	// ErrScheduledNotFound is returned when cancelling a scheduled job that
+	// doesn't exist or has already been sent
+	ErrScheduledNotFound = errors.New("scheduled job not found or already sent")
+)
+
+// deferJob holds onto the job until at and then pushes it into queue,
+// returning an ID for the deferred job. Deferred jobs are stored in mongo so
+// they survive restarts and can be released by any instance. If mongo is
+// disabled then the job is only held in memory
+func deferJob(queue, contents string, at time.Time) (string, error) {
+	id := bson.NewObjectId()
+	if mongoDisabled {
+		time.AfterFunc(at.Sub(time.Now()), func() {
+			if err := storeJob(queue, contents); err != nil {
+				llog.Error("error releasing deferred job", llog.KV{
+					"queue":       queue,
+					"jobContents": contents,
+				}, llog.ErrKV(err))
+			}
+		})
+		return id.Hex(), nil
+	}
+
+	doc := &deferredDoc{
+		ID:       id,
+		Queue:    queue,
+		Contents: contents,
+		At:       at,
+	}
+	var err error
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		err = c.Insert(doc)
+	})
+	return id.Hex(), err
+}
+
+// StoreScheduledSendJob holds onto the Mail job with jobContents until at, and
+// then sends it to okq into the queue for priority. It returns an ID which can
+// be passed to CancelScheduledSendJob
+func StoreScheduledSendJob(jobContents, priority string, at time.Time) (string, error) {
+	// since scheduled jobs can be held for a long time we don't want to only
+	// hold them in memory
+	if mongoDisabled {
+		return "", MongoDisabledErr
+	}
+	return deferJob(sendQueue(priority), jobContents, at)
+}
+
+// CancelScheduledSendJob cancels a job that was stored with
+// StoreScheduledSendJob. ErrScheduledNotFound is returned if the job doesn't
+// exist or is already being sent
+func CancelScheduledSendJob(id string) error {
+	if mongoDisabled {
+		return MongoDisabledErr
+	}
+	if !bson.IsObjectIdHex(id) {
+		return ErrScheduledNotFound
+	}
+	var err error
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		err = c.Remove(bson.M{
+			"_id": bson.ObjectIdHex(id),
+			"q":   bson.M{"$in": sendQueues()},
+			// if it's locked then it's being released right now
+			"l": bson.M{"$lte": time.Now()},
+		})
+	})
+	if err == mgo.ErrNotFound {
+		return ErrScheduledNotFound
+	}
+	return err
+}
+
+// deferSpin releases deferred jobs as they become due
+func deferSpin() {
+	for range time.Tick(deferPoll) {
+		for releaseDeferred() {
+		}
+	}
+}
+
+// releaseDeferred claims a single deferred job which is due and pushes it into
+// its queue. It returns true if there may be more jobs which are due
+func releaseDeferred() bool {
+	now := time.Now()
+	doc := &deferredDoc{}
+	var err error
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		q := bson.M{
+			"at": bson.M{"$lte": now},
+			"l":  bson.M{"$lte": now},
+		}
+		_, err = c.Find(q).Sort("at").Apply(mgo.Change{
+			Update:    bson.M{"$set": bson.M{"l": now.Add(deferLock)}},
+			ReturnNew: true,
+		}, doc)
+	})
+	if err == mgo.ErrNotFound {
+		return false
+	} else if err != nil {
+		llog.Error("error claiming deferred job", llog.ErrKV(err))
+		return false
+	}
+
+	kv := llog.KV{"id": doc.ID.Hex(), "queue": doc.Queue}
+	if err = storeJob(doc.Queue, doc.Contents); err != nil {
+		// it'll be released again once the lock passes
+		llog.Error("error releasing deferred job", kv, llog.ErrKV(err))
+		return true
+	}
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		err = c.RemoveId(doc.ID)
+	})
+	if err != nil {
+		llog.Error("error removing released deferred job", kv, llog.ErrKV(err))
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/postmaster/sender"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDeferJob(t *T) {
+	require.False(t, mongoDisabled)
+	require.True(t, useOkq)
+	q := testutil.RandStr()
+
+	id, err := deferJob(q, "deferred", time.Now().Add(2*time.Second))
+	require.Nil(t, err)
+
+	// it shouldn't be released before it's due
+	assert.False(t, releaseDeferred())
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		n, err := c.FindId(bson.ObjectIdHex(id)).Count()
+		require.Nil(t, err)
+		assert.Equal(t, 1, n)
+	})
+
+	// deferSpin is running so it'll be released on its own
+	time.Sleep(3 * time.Second)
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		n, err := c.FindId(bson.ObjectIdHex(id)).Count()
+		require.Nil(t, err)
+		assert.Equal(t, 0, n)
+	})
+
+	r, err := redis.DialTimeout("tcp", okqAddr, 5*time.Second)
+	require.Nil(t, err)
+	res, err := r.Cmd("QRPOP", q, "EX", 0).Array()
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	cont, err := res[1].Str()
+	require.Nil(t, err)
+	assert.Equal(t, "deferred", cont)
+}
+
+func TestScheduledSendJob(t *T) {
+	require.False(t, mongoDisabled)
+
+	id, err := StoreScheduledSendJob("scheduled", sender.PriorityLow, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		doc := &deferredDoc{}
+		require.Nil(t, c.FindId(bson.ObjectIdHex(id)).One(doc))
+		assert.Equal(t, lowQueue, doc.Queue)
+		assert.Equal(t, "scheduled", doc.Contents)
+	})
+
+	require.Nil(t, CancelScheduledSendJob(id))
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		n, err := c.FindId(bson.ObjectIdHex(id)).Count()
+		require.Nil(t, err)
+		assert.Equal(t, 0, n)
+	})
+	assert.Equal(t, ErrScheduledNotFound, CancelScheduledSendJob(id))
+	assert.Equal(t, ErrScheduledNotFound, CancelScheduledSendJob("nope"))
+
+	// a job that's being released can't be cancelled
+	id, err = StoreScheduledSendJob("scheduled", "", time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	deferredSH.WithColl(func(c *mgo.Collection) {
+		err := c.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"l": time.Now().Add(deferLock)}})
+		require.Nil(t, err)
+	})
+	assert.Equal(t, ErrScheduledNotFound, CancelScheduledSendJob(id))
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"time"
+
+	"github.com/levenlabs/golib/mgoutil"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// uniqueClaimKey identifies a recipient and uniqueID pair
+type uniqueClaimKey struct {
+	Recipient string `bson:"r"`
+	UniqueID  string `bson:"u"`
+}
+
+var (
+	uniqueClaimsSH   mgoutil.SessionHelper
+	uniqueClaimsColl = "uniqueclaims"
+)
+
+// ClaimUniqueID atomically checks that no email with the uniqueID was sent to
+// the recipient within interval and claims the pair so that no other email with
+// it can be enqueued within interval either. False is returned if there was
+// one, in which case the email shouldn't be sent
+func ClaimUniqueID(recipient, uid string, interval time.Duration) (bool, error) {
+	if mongoDisabled {
+		return false, MongoDisabledErr
+	}
+	now := time.Now()
+
+	// emails which were sent before we started claiming uniqueIDs only have
+	// their stats
+	last, err := GetLastUniqueID(recipient, uid)
+	if err != nil && err != mgo.ErrNotFound {
+		return false, err
+	} else if last != nil && now.Sub(last.TSCreated.Time) < interval {
+		return false, nil
+	}
+
+	key := uniqueClaimKey{Recipient: recipient, UniqueID: uid}
+	uniqueClaimsSH.WithColl(func(c *mgo.Collection) {
+		// if there's a claim within the interval then this won't match it and
+		// will try to insert a new one, which fails since the _id is taken
+		q := bson.M{"_id": key, "t": bson.M{"$lte": now.Add(-interval)}}
+		_, err = c.Find(q).Apply(mgo.Change{
+			Update: bson.M{"$set": bson.M{"t": now, "exp": now.Add(interval)}},
+			Upsert: true,
+		}, nil)
+	})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseUniqueID removes the claim made by ClaimUniqueID after the email
+// wasn't enqueued after all
+func ReleaseUniqueID(recipient, uid string) error {
+	if mongoDisabled {
+		return MongoDisabledErr
+	}
+	var err error
+	uniqueClaimsSH.WithColl(func(c *mgo.Collection) {
+		err = c.RemoveId(uniqueClaimKey{Recipient: recipient, UniqueID: uid})
+	})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return err
+}
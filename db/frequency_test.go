@@ -0,0 +1,52 @@
+package db
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimUniqueID(t *T) {
+	require.False(t, mongoDisabled)
+	email := testutil.RandStr() + "@test.com"
+	uid := testutil.RandStr()
+
+	ok, err := ClaimUniqueID(email, uid, time.Hour)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = ClaimUniqueID(email, uid, time.Hour)
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	// other uniqueIDs aren't affected
+	ok, err = ClaimUniqueID(email, testutil.RandStr(), time.Hour)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	// once released it can be claimed again
+	require.Nil(t, ReleaseUniqueID(email, uid))
+	ok, err = ClaimUniqueID(email, uid, time.Hour)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	// once the interval passes it can be claimed again
+	time.Sleep(1100 * time.Millisecond)
+	ok, err = ClaimUniqueID(email, uid, time.Second)
+	require.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestClaimUniqueIDStats(t *T) {
+	require.False(t, mongoDisabled)
+	email := testutil.RandStr() + "@test.com"
+	uid := testutil.RandStr()
+
+	// an email sent without a claim still counts
+	require.NotEmpty(t, GenerateEmailID(email, 1, uid, "production"))
+	ok, err := ClaimUniqueID(email, uid, time.Hour)
+	require.Nil(t, err)
+	assert.False(t, ok)
+}
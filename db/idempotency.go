@@ -0,0 +1,128 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/levenlabs/golib/mgoutil"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// IdempotentResult is the result of an enqueue which is stored under its
+// idempotency key, so it can be returned again when the enqueue is retried
+type IdempotentResult struct {
+	StatsID    string `bson:"sid,omitempty"`
+	JobID      string `bson:"jid,omitempty"`
+	Suppressed bool   `bson:"sup,omitempty"`
+	Skipped    bool   `bson:"skip,omitempty"`
+	SkipReason string `bson:"skipr,omitempty"`
+}
+
+// idempotencyDoc tracks an idempotency key from when it's first claimed until
+// it expires
+type idempotencyDoc struct {
+	Key string `bson:"_id"`
+
+	// Done is set once Result has been stored
+	Done   bool             `bson:"done"`
+	Result IdempotentResult `bson:"res"`
+
+	// LockedUntil is how long the enqueue which claimed the key has to finish.
+	// If it dies before finishing the key can be claimed again after this
+	LockedUntil time.Time `bson:"l"`
+
+	// Expires is when the key can be used again. It's removed sometime after
+	// by mongo
+	Expires time.Time `bson:"exp"`
+}
+
+var (
+	idempotencySH   mgoutil.SessionHelper
+	idempotencyColl = "idempotency"
+
+	// idempotencyTTL is how long idempotency keys are remembered for
+	idempotencyTTL = 24 * time.Hour
+
+	// idempotencyLock is how long an enqueue has to finish after claiming its
+	// idempotency key
+	idempotencyLock = time.Minute
+
+	// ErrIdempotencyInProgress is returned when another enqueue with the same
+	// idempotency key is still being processed
+	ErrIdempotencyInProgress = errors.New("enqueue with this idempotencyKey is already in progress")
+)
+
+// ClaimIdempotencyKey claims key for an enqueue. If the key was already used
+// within the TTL then the result of that enqueue is returned and nothing else
+// should be done. Otherwise nil is returned and either StoreIdempotentResult or
+// ReleaseIdempotencyKey must be called once the enqueue is finished. If mongo is
+// disabled keys aren't tracked and nil is always returned
+func ClaimIdempotencyKey(key string) (*IdempotentResult, error) {
+	if mongoDisabled {
+		return nil, nil
+	}
+	now := time.Now()
+	doc := &idempotencyDoc{
+		Key:         key,
+		LockedUntil: now.Add(idempotencyLock),
+		Expires:     now.Add(idempotencyTTL),
+	}
+	var existing idempotencyDoc
+	var err error
+	idempotencySH.WithColl(func(c *mgo.Collection) {
+		if err = c.Insert(doc); !mgo.IsDup(err) {
+			return
+		}
+		if err = c.FindId(key).One(&existing); err != nil {
+			return
+		}
+		if existing.Expires.After(now) && (existing.Done || existing.LockedUntil.After(now)) {
+			return
+		}
+		// the key expired but hasn't been removed by mongo yet, or whoever
+		// claimed it died, so take it over as long as no one else has
+		err = c.Update(bson.M{"_id": key, "l": existing.LockedUntil}, doc)
+		if err == mgo.ErrNotFound {
+			err = ErrIdempotencyInProgress
+		}
+		existing = idempotencyDoc{}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if existing.Done {
+		return &existing.Result, nil
+	} else if existing.Key != "" {
+		return nil, ErrIdempotencyInProgress
+	}
+	return nil, nil
+}
+
+// StoreIdempotentResult stores the result of the enqueue which claimed key
+func StoreIdempotentResult(key string, res *IdempotentResult) error {
+	if mongoDisabled {
+		return nil
+	}
+	var err error
+	idempotencySH.WithColl(func(c *mgo.Collection) {
+		err = c.UpdateId(key, bson.M{"$set": bson.M{"done": true, "res": res}})
+	})
+	return err
+}
+
+// ReleaseIdempotencyKey removes the claim on key after its enqueue failed, so
+// that it can be retried
+func ReleaseIdempotencyKey(key string) error {
+	if mongoDisabled {
+		return nil
+	}
+	var err error
+	idempotencySH.WithColl(func(c *mgo.Collection) {
+		err = c.Remove(bson.M{"_id": key, "done": false})
+	})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIdempotencyKey(t *T) {
+	require.False(t, mongoDisabled)
+	key := testutil.RandStr()
+
+	prev, err := ClaimIdempotencyKey(key)
+	require.Nil(t, err)
+	assert.Nil(t, prev)
+
+	// it's claimed but not done yet
+	_, err = ClaimIdempotencyKey(key)
+	assert.Equal(t, ErrIdempotencyInProgress, err)
+
+	res := &IdempotentResult{StatsID: "sid", JobID: "jid"}
+	require.Nil(t, StoreIdempotentResult(key, res))
+	prev, err = ClaimIdempotencyKey(key)
+	require.Nil(t, err)
+	assert.Equal(t, res, prev)
+
+	// once it expires it can be claimed again
+	idempotencySH.WithColl(func(c *mgo.Collection) {
+		require.Nil(t, c.UpdateId(key, bson.M{"$set": bson.M{"exp": time.Now().Add(-time.Second)}}))
+	})
+	prev, err = ClaimIdempotencyKey(key)
+	require.Nil(t, err)
+	assert.Nil(t, prev)
+}
+
+func TestReleaseIdempotencyKey(t *T) {
+	require.False(t, mongoDisabled)
+	key := testutil.RandStr()
+
+	_, err := ClaimIdempotencyKey(key)
+	require.Nil(t, err)
+	require.Nil(t, ReleaseIdempotencyKey(key))
+	prev, err := ClaimIdempotencyKey(key)
+	require.Nil(t, err)
+	assert.Nil(t, prev)
+
+	// a stale claim can be taken over
+	idempotencySH.WithColl(func(c *mgo.Collection) {
+		require.Nil(t, c.UpdateId(key, bson.M{"$set": bson.M{"l": time.Now().Add(-time.Second)}}))
+	})
+	prev, err = ClaimIdempotencyKey(key)
+	require.Nil(t, err)
+	assert.Nil(t, prev)
+}
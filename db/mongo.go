@@ -19,6 +19,20 @@ type EmailDoc struct {
 	Bounces     []time.Time `bson:"b"` //also includes *some* drops
 	SpamReports []time.Time `bson:"s"`
 	TSUpdated   time.Time   `bson:"ts"`
+
+	// HardBounces, SoftBounces and Blocks are the times of the Bounces in each
+	// class. Bounces from before they were classified aren't in any of them
+	HardBounces []time.Time `bson:"hb,omitempty"`
+	SoftBounces []time.Time `bson:"sb,omitempty"`
+	Blocks      []time.Time `bson:"bk,omitempty"`
+
+	// LastBounce is the classification of the most recent bounce
+	LastBounce *Bounce `bson:"lb,omitempty"`
+
+	// SuppressionsCleared is the last time the address's suppression was
+	// cleared, Bounces and SpamReports from before then don't count towards
+	// the --suppression-policies
+	SuppressionsCleared time.Time `bson:"sc,omitempty"`
 }
 
 var (
@@ -35,14 +49,55 @@ var (
 
 func init() {
 	ga.GA.AppendInit(func(g *genapi.GenAPI) {
+		ttl, _ := g.ParamStr("--idempotency-ttl")
+		var err error
+		if idempotencyTTL, err = time.ParseDuration(ttl); err != nil {
+			llog.Fatal("invalid --idempotency-ttl", llog.ErrKV(err))
+		}
+		ttl, _ = g.ParamStr("--webhook-event-ttl")
+		if webhookEventTTL, err = time.ParseDuration(ttl); err != nil {
+			llog.Fatal("invalid --webhook-event-ttl", llog.ErrKV(err))
+		}
+		policies, _ := g.ParamStr("--suppression-policies")
+		if suppressionPolicies, err = parseSuppressionPolicies(policies); err != nil {
+			llog.Fatal("invalid --suppression-policies", llog.KV{"policies": policies}, llog.ErrKV(err))
+		}
+
 		emailSH = g.MongoInfo.CollSH(emailsColl)
 		if emailSH.Session == nil {
 			mongoDisabled = true
 			return
 		}
+		emailSH.MustEnsureIndexes(
+			mgo.Index{Key: []string{"ts"}},
+		)
 		statsSH = g.MongoInfo.CollSH(statsColl)
 		statsSH.MustEnsureIndexes(
 			mgo.Index{Key: []string{"uid", "r", "tc"}, Sparse: true},
+			mgo.Index{Key: []string{"rt", "tc"}, Sparse: true},
+			mgo.Index{Key: []string{"r", "tc"}},
+			mgo.Index{Key: []string{"tc"}},
+		)
+		deferredSH = g.MongoInfo.CollSH(deferredColl)
+		deferredSH.MustEnsureIndexes(
+			mgo.Index{Key: []string{"at"}},
+		)
+		idempotencySH = g.MongoInfo.CollSH(idempotencyColl)
+		idempotencySH.MustEnsureIndexes(
+			mgo.Index{Key: []string{"exp"}, ExpireAfter: time.Second},
+		)
+		uniqueClaimsSH = g.MongoInfo.CollSH(uniqueClaimsColl)
+		uniqueClaimsSH.MustEnsureIndexes(
+			mgo.Index{Key: []string{"exp"}, ExpireAfter: time.Second},
+		)
+		webhookEventsSH = g.MongoInfo.CollSH(webhookEventsColl)
+		webhookEventsSH.MustEnsureIndexes(
+			mgo.Index{Key: []string{"exp"}, ExpireAfter: time.Second},
+		)
+		deadSH = g.MongoInfo.CollSH(deadColl)
+		deadSH.MustEnsureIndexes(
+			mgo.Index{Key: []string{"r", "tc"}},
+			mgo.Index{Key: []string{"tc"}},
 		)
 	})
 }
@@ -50,9 +105,20 @@ func init() {
 // VerifyEmailAllowed verifies that we're allowed to send an email with flags to
 // recipient
 func VerifyEmailAllowed(email string, flags int64) bool {
+	allowed, err := emailAllowed(email, flags)
+	if err != nil {
+		llog.Error("error searching for doc by email", llog.KV{"email": email, "err": err})
+		return false
+	}
+	return allowed
+}
+
+// emailAllowed is like VerifyEmailAllowed but returns errors rather than
+// treating them as not allowed
+func emailAllowed(email string, flags int64) (bool, error) {
 	if mongoDisabled {
 		//if they didn't run with mongo then they must want to approve all emails
-		return true
+		return true, nil
 	}
 	res := &EmailDoc{}
 	var err error
@@ -62,14 +128,16 @@ func VerifyEmailAllowed(email string, flags int64) bool {
 	if err != nil {
 		//if the error is a not found error then its allowed since its not explicitly blocked
 		if err == mgo.ErrNotFound {
-			return true
+			return true, nil
 		}
-		llog.Error("error searching for doc by email", llog.KV{"email": email, "err": err})
-		return false
+		return false, err
+	}
+	if suppressionReason(res, time.Now()) != "" {
+		return false, nil
 	}
 	//if none of the flags are present then its allowed
 	//we check == 0 (and not != flags) since we want to know if they blocked ANY of the flags
-	return res.UnsubFlags&flags == 0
+	return res.UnsubFlags&flags == 0, nil
 }
 
 // StoreEmailFlags updates the email with new flags restrictions
@@ -85,13 +153,16 @@ func StoreEmailFlags(email string, flags int64) error {
 	return err
 }
 
-// StoreEmailBounce stores a new time when the email bounced
-func StoreEmailBounce(email string) error {
+// AddEmailFlags adds flags to the email's flags restrictions, keeping the ones
+// which were already there
+func AddEmailFlags(email string, flags int64) error {
 	if mongoDisabled {
 		return MongoDisabledErr
 	}
-	n := time.Now()
-	update := bson.M{"$push": bson.M{"b": n, "ts": n}}
+	update := bson.M{
+		"$bit": bson.M{"f": bson.M{"or": flags}},
+		"$set": bson.M{"ts": time.Now()},
+	}
 	var err error
 	emailSH.WithColl(func(c *mgo.Collection) {
 		_, err = c.UpsertId(email, update)
@@ -99,13 +170,20 @@ func StoreEmailBounce(email string) error {
 	return err
 }
 
-// StoreEmailSpam stores a new time when the email was spammed
-func StoreEmailSpam(email string) error {
+// StoreEmailBounce stores the time the email bounced along with the bounce's
+// classification. at is the time the provider said it bounced, and if it's
+// zero then now is used
+func StoreEmailBounce(email string, b *Bounce, at time.Time) error {
 	if mongoDisabled {
 		return MongoDisabledErr
 	}
-	n := time.Now()
-	update := bson.M{"$push": bson.M{"s": n, "ts": n}}
+	n := eventTime(at)
+	push := bson.M{"b": n}
+	update := bson.M{"$push": push, "$max": bson.M{"ts": n}}
+	if b != nil {
+		push[bounceClassFields[b.Class]] = n
+		update["$set"] = bson.M{"lb": b}
+	}
 	var err error
 	emailSH.WithColl(func(c *mgo.Collection) {
 		_, err = c.UpsertId(email, update)
@@ -113,6 +191,30 @@ func StoreEmailSpam(email string) error {
 	return err
 }
 
+// StoreEmailSpam stores the time the email was reported as spam. at is the time
+// the provider said it was reported, and if it's zero then now is used
+func StoreEmailSpam(email string, at time.Time) error {
+	if mongoDisabled {
+		return MongoDisabledErr
+	}
+	n := eventTime(at)
+	// events can arrive out of order so ts only ever moves forward
+	update := bson.M{"$push": bson.M{"s": n}, "$max": bson.M{"ts": n}}
+	var err error
+	emailSH.WithColl(func(c *mgo.Collection) {
+		_, err = c.UpsertId(email, update)
+	})
+	return err
+}
+
+// eventTime returns at, or now if at is zero
+func eventTime(at time.Time) time.Time {
+	if at.IsZero() {
+		return time.Now()
+	}
+	return at
+}
+
 // MoveEmailPrefs and email's prefs to a new address
 func MoveEmailPrefs(oldEmail, newEmail string) error {
 	if mongoDisabled {
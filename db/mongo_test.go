@@ -41,7 +41,8 @@ func TestStoreEmailBounce(t *T) {
 	require.False(t, mongoDisabled)
 	emailSH.WithColl(func(c *mgo.Collection) {
 		email := "test2@test.com"
-		err := StoreEmailBounce(email)
+		b := &Bounce{Class: BounceHard, Code: 550, Status: "5.1.1"}
+		err := StoreEmailBounce(email, b, time.Time{})
 		require.Nil(t, err)
 		doc := &EmailDoc{}
 		err = c.FindId(email).One(doc)
@@ -51,6 +52,9 @@ func TestStoreEmailBounce(t *T) {
 		//make sure bounce time is within 1 second
 		diff := time.Now().Sub(doc.Bounces[0])
 		assert.True(t, diff < time.Second)
+		assert.Equal(t, doc.Bounces, doc.HardBounces)
+		assert.Empty(t, doc.SoftBounces)
+		assert.Equal(t, b, doc.LastBounce)
 	})
 }
 
@@ -58,7 +62,7 @@ func TestStoreEmailSpam(t *T) {
 	require.False(t, mongoDisabled)
 	emailSH.WithColl(func(c *mgo.Collection) {
 		email := "test3@test.com"
-		err := StoreEmailSpam(email)
+		err := StoreEmailSpam(email, time.Time{})
 		require.Nil(t, err)
 		doc := &EmailDoc{}
 		err = c.FindId(email).One(doc)
@@ -5,6 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/levenlabs/go-llog"
@@ -12,15 +16,33 @@ import (
 	"github.com/levenlabs/postmaster/ga"
 	"github.com/levenlabs/postmaster/sender"
 	"github.com/mediocregopher/okq-go.v2"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
+	highQueue       = "email-high"
 	normalQueue     = "email-normal"
+	lowQueue        = "email-low"
 	statsQueue      = "stats-normal"
 	uniqueArgStatID = "pmStatsID"
 	uniqueArgEnvID  = "pmEnvID"
 )
 
+var (
+	// maxSendAttempts is how many times an email is tried before giving up
+	maxSendAttempts = 8
+
+	// retryBackoff is how long we wait after the first failed attempt, which
+	// doubles after each following attempt up to maxRetryBackoff
+	retryBackoff    = 30 * time.Second
+	maxRetryBackoff = time.Hour
+
+	// queueWorkers is how many jobs are processed from each queue at once.
+	// Queues which aren't in it get a single worker
+	queueWorkers = map[string]int{}
+)
+
 var jobCh chan job
 
 var useOkq bool
@@ -31,8 +53,66 @@ type job struct {
 	RespCh   chan error
 }
 
+// sendJob is what's stored in the send queue. It embeds the sender.Mail that was
+// enqueued so that jobs pushed before these fields existed still decode
+type sendJob struct {
+	sender.Mail
+
+	// Attempts is how many times sending this email has failed so far
+	Attempts int `json:"pmAttempts,omitempty"`
+}
+
 func init() {
 	ga.GA.AppendInit(func(g *genapi.GenAPI) {
+		maxSendAttempts, _ = g.ParamInt("--send-max-attempts")
+		if maxSendAttempts < 1 {
+			llog.Fatal("--send-max-attempts must be at least 1")
+		}
+		var err error
+		str, _ := g.ParamStr("--send-retry-backoff")
+		if retryBackoff, err = time.ParseDuration(str); err != nil {
+			llog.Fatal("invalid --send-retry-backoff", llog.ErrKV(err))
+		}
+		str, _ = g.ParamStr("--send-retry-max-backoff")
+		if maxRetryBackoff, err = time.ParseDuration(str); err != nil {
+			llog.Fatal("invalid --send-retry-max-backoff", llog.ErrKV(err))
+		}
+		if retryBackoff <= 0 || maxRetryBackoff < retryBackoff {
+			llog.Fatal("--send-retry-backoff must be positive and no more than --send-retry-max-backoff")
+		}
+
+		str, _ = g.ParamStr("--queue-workers")
+		if queueWorkers, err = parseQueueWorkers(str); err != nil {
+			llog.Fatal("invalid --queue-workers", llog.KV{"workers": str}, llog.ErrKV(err))
+		}
+
+		str, _ = g.ParamStr("--frequency-caps")
+		if frequencyCaps, err = parseFrequencyCaps(str); err != nil {
+			llog.Fatal("invalid --frequency-caps", llog.KV{"caps": str}, llog.ErrKV(err))
+		}
+		str, _ = g.ParamStr("--domain-rates")
+		if domainLimits, err = parseDomainRates(str); err != nil {
+			llog.Fatal("invalid --domain-rates", llog.KV{"rates": str}, llog.ErrKV(err))
+		}
+		str, _ = g.ParamStr("--warmup-routes")
+		if warmupStarts, err = parseWarmupRoutes(str); err != nil {
+			llog.Fatal("invalid --warmup-routes", llog.KV{"routes": str}, llog.ErrKV(err))
+		}
+		warmupStartVolume, _ = g.ParamInt("--warmup-start-volume")
+		warmupTargetVolume, _ = g.ParamInt("--warmup-target-volume")
+		warmupDays, _ = g.ParamInt("--warmup-days")
+		if warmupStartVolume < 1 || warmupTargetVolume < warmupStartVolume || warmupDays < 1 {
+			llog.Fatal("invalid warmup schedule")
+		}
+
+		// mongo.go's init has already run so mongoDisabled is set
+		if !mongoDisabled {
+			go deferSpin()
+		} else if len(warmupStarts) > 0 {
+			// warmups are counted using the stats in mongo
+			llog.Fatal("--warmup-routes requires mongo")
+		}
+
 		if ga.GA.OkqInfo.Client == nil {
 			return
 		}
@@ -42,12 +122,17 @@ func init() {
 		// Receive jobs from StoreSendJob() and StoreStatsJob() and Push into okq
 		go func() {
 			for job := range jobCh {
+				// every priority has its own queue so jobs are never pushed
+				// to the front, which would send the newest ones first
 				job.RespCh <- okqClient.Push(job.Queue, job.Contents, okq.Normal)
 			}
 		}()
 
-		// Receive jobs from okq and send to sender
-		consumeSpin(handleSendEvent, normalQueue)
+		// Receive jobs from okq and send to sender. Each priority gets its own
+		// consumer so lower priorities can't hold up higher ones
+		for _, q := range sendQueues() {
+			consumeSpin(handleSendEvent, q)
+		}
 
 		// Receive jobs from okq and store in stats
 		consumeSpin(handleStatsEvent, statsQueue)
@@ -62,41 +147,92 @@ func DisableOkq() {
 	useOkq = false
 }
 
+// parseQueueWorkers parses a spec in the form of queue=workers,...
+func parseQueueWorkers(spec string) (map[string]int, error) {
+	m := map[string]int{}
+	if strings.TrimSpace(spec) == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid queue workers %q", part)
+		}
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid workers for queue %q", part[:i])
+		}
+		m[part[:i]] = n
+	}
+	return m, nil
+}
+
+// consumeSpin starts the configured number of consumers for the queue, each of
+// which processes one job at a time
 func consumeSpin(fn okq.ConsumerFunc, q string) {
-	llog.Info("creating okq consumer", llog.KV{"queue": q})
+	n := queueWorkers[q]
+	if n < 1 {
+		n = 1
+	}
+	llog.Info("creating okq consumers", llog.KV{"queue": q, "workers": n})
 	consumer := ga.GA.OkqInfo.Client
-	go func(c *okq.Client) {
-		for {
-			err := <-c.Consumer(context.Background(), fn, q)
-			llog.Error("consumer error", llog.KV{"queue": q}, llog.ErrKV(err))
-			time.Sleep(10 * time.Second)
-		}
-	}(consumer)
+	for i := 0; i < n; i++ {
+		go func(c *okq.Client) {
+			for {
+				err := <-c.Consumer(context.Background(), fn, q)
+				llog.Error("consumer error", llog.KV{"queue": q}, llog.ErrKV(err))
+				time.Sleep(10 * time.Second)
+			}
+		}(consumer)
+	}
 }
 
 // StoreSendJob creates a new Mail job with jobContents and sends it to okq
-func StoreSendJob(jobContents string) error {
-	if !useOkq {
-		if !sendEmail(jobContents) {
-			return errors.New("Failed to send email (bypassing okq)")
-		}
-		return nil
+// into the queue for priority
+func StoreSendJob(jobContents, priority string) error {
+	return storeJob(sendQueue(priority), jobContents)
+}
+
+// sendQueue returns the queue that emails with priority are sent from
+func sendQueue(priority string) string {
+	switch priority {
+	case sender.PriorityHigh:
+		return highQueue
+	case sender.PriorityLow:
+		return lowQueue
 	}
-	respCh := make(chan error)
-	jobCh <- job{normalQueue, jobContents, respCh}
-	return <-respCh
+	return normalQueue
+}
+
+// sendQueues returns all of the queues that emails are sent from
+func sendQueues() []string {
+	return []string{highQueue, normalQueue, lowQueue}
 }
 
 // StoreStatsJob creates a new statsJob with jobContents and sends it to okq
 func StoreStatsJob(jobContents string) error {
+	return storeJob(statsQueue, jobContents)
+}
+
+// storeJob pushes jobContents into the queue, or handles it immediately if
+// we're not using okq
+func storeJob(queue, jobContents string) error {
 	if !useOkq {
-		if !storeStats(jobContents) {
-			return errors.New("Failed to store stats (bypassing okq)")
+		switch queue {
+		case statsQueue:
+			if !storeStats(jobContents) {
+				return errors.New("Failed to store stats (bypassing okq)")
+			}
+		default:
+			if !sendEmail(jobContents) {
+				return errors.New("Failed to send email (bypassing okq)")
+			}
 		}
 		return nil
 	}
 	respCh := make(chan error)
-	jobCh <- job{statsQueue, jobContents, respCh}
+	jobCh <- job{queue, jobContents, respCh}
 	return <-respCh
 }
 
@@ -108,9 +244,23 @@ func handleStatsEvent(_ context.Context, e okq.Event) bool {
 	return storeStats(e.Contents)
 }
 
+// retryDelay returns how long to wait before trying an email again after it has
+// failed attempts times. Up to half of the delay is random so that emails
+// which failed at the same time don't all get retried at the same time
+func retryDelay(attempts int) time.Duration {
+	d := retryBackoff
+	for i := 1; i < attempts && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func sendEmail(jobContents string) bool {
-	job := new(sender.Mail)
-	err := json.Unmarshal([]byte(jobContents), job)
+	sj := new(sendJob)
+	err := json.Unmarshal([]byte(jobContents), sj)
 	if err != nil {
 		llog.Error("error json decoding into sender.Mail", llog.KV{
 			"jobContents": jobContents,
@@ -118,9 +268,83 @@ func sendEmail(jobContents string) bool {
 		// since we cannot process this job, no reason to have it keep around
 		return true
 	}
+	job := &sj.Mail
+
+	if job.ExpiresAt != nil && time.Now().After(job.ExpiresAt.Time) {
+		id := storeUnsent(job, Expired, expiredReason)
+		llog.Warn("dropping expired email", llog.KV{
+			"id":        id,
+			"recipient": job.To,
+			"expiresAt": job.ExpiresAt,
+		})
+		return true
+	}
+
+	// the caps were checked when the email was enqueued but other emails to
+	// the recipient could have been sent since then
+	if over, err := OverFrequencyCap(job.To, job.Flags); err != nil {
+		llog.Error("error checking frequency caps", llog.KV{"recipient": job.To}, llog.ErrKV(err))
+		return false
+	} else if over {
+		id := SuppressEmail(job, SuppressedFrequencyCap)
+		llog.Info("suppressing email over frequency cap", llog.KV{"id": id, "recipient": job.To})
+		return true
+	}
+
+	queue := sendQueue(sender.PickPriority(job))
 
 	env := ga.Environment
-	id := GenerateEmailID(job.To, job.Flags, job.UniqueID, env)
+	route := sender.PickRoute(job)
+	if d, err := warmupDelay(route.Name); err != nil {
+		llog.Error("error checking route warmup", llog.KV{"route": route.Name}, llog.ErrKV(err))
+		return false
+	} else if d > 0 {
+		return deferSendJob(sj, queue, d, "route warmup limit reached")
+	}
+
+	// the recipient could have changed their prefs while the email was
+	// waiting to be sent
+	if allowed, err := emailAllowed(job.To, job.Flags); err != nil {
+		llog.Error("error checking recipient prefs", llog.KV{"recipient": job.To}, llog.ErrKV(err))
+		return false
+	} else if !allowed {
+		id := SuppressEmail(job, SuppressedPrefs)
+		llog.Info("suppressing email blocked by prefs", llog.KV{"id": id, "recipient": job.To})
+		return true
+	}
+
+	// the domain's slot is reserved as late as possible so that emails which
+	// end up not being sent don't use one up
+	if d := domainDelay(job.To); d > deferPoll {
+		// the slots are only known to this process and the deferred job could
+		// be picked up by any of them, so rather than holding onto the slot
+		// the job reserves one again once it's back
+		releaseDomainDelay(job.To)
+		return deferSendJob(sj, queue, d, "domain rate limited")
+	} else if d > 0 {
+		time.Sleep(d)
+	}
+
+	// if we're over the send rate then leave the job in the queue so the
+	// workers slow down rather than piling up emails in memory
+	if err = sender.Throttle(); err != nil {
+		releaseDomainDelay(job.To)
+		llog.Warn("send rate limited, leaving job in queue", llog.KV{"recipient": job.To})
+		return false
+	}
+
+	doc := &StatDoc{
+		Recipient:       job.To,
+		EmailFlags:      job.Flags,
+		UniqueID:        job.UniqueID,
+		SentEnvironment: env,
+		Route:           route.Name,
+	}
+	// use the ID that was handed out in AssignStatsID if there is one
+	if sid := job.UniqueArgs[uniqueArgStatID]; bson.IsObjectIdHex(sid) {
+		doc.ID = bson.ObjectIdHex(sid)
+	}
+	id := generateEmailID(doc)
 	if id != "" {
 		if job.UniqueArgs == nil {
 			job.UniqueArgs = make(map[string]string)
@@ -129,20 +353,84 @@ func sendEmail(jobContents string) bool {
 		job.UniqueArgs[uniqueArgEnvID] = env
 	}
 
-	llog.Info("processing send job", llog.KV{"id": id, "recipient": job.To})
-	err = sender.Send(job)
-	if err != nil {
+	llog.Info("processing send job", llog.KV{"id": id, "recipient": job.To, "route": route.Name})
+	via, err := route.Send(job)
+	if err == nil {
+		if id != "" && via != route.Name {
+			// the route failed over so record the route that actually sent
+			// it, which is also what warmups are counted by
+			if rerr := setEmailRoute(id, via); rerr != nil {
+				llog.Error("error storing email's route", llog.KV{"id": id, "route": via}, llog.ErrKV(rerr))
+			}
+		}
+		return true
+	}
+	if err == sender.ErrRateLimited {
+		// the email wasn't attempted so it doesn't use up an attempt
+		llog.Warn("provider rate limited, leaving job in queue", llog.KV{"id": id, "route": route.Name})
+		releaseDomainDelay(job.To)
 		if id != "" {
-			// if we ran into an error sending the email, delete the emailID
-			rerr := removeEmailID(id)
-			if rerr != nil {
-				llog.Error("error deleting failed emailID", llog.KV{"id": id}, llog.ErrKV(err))
+			if rerr := removeEmailID(id); rerr != nil {
+				llog.Error("error deleting rate limited emailID", llog.KV{"id": id}, llog.ErrKV(rerr))
 			}
 		}
+		return false
+	}
+
+	sj.Attempts++
+	kv := llog.KV{"jobContents": jobContents, "id": id, "attempts": sj.Attempts}
+	if sender.IsPermanent(err) || sj.Attempts >= maxSendAttempts {
+		llog.Error("error calling sender.Send, giving up", kv, llog.ErrKV(err))
+		reason := err.Error()
+		if !sender.IsPermanent(err) {
+			reason = fmt.Sprintf("gave up after %d attempts: %s", sj.Attempts, reason)
+		}
+		if id != "" {
+			logMarkError(MarkAsFailed(id, reason), kv)
+		}
+		// sj can always be marshaled since it was just unmarshaled
+		contents, _ := json.Marshal(sj)
+		if derr := storeDeadLetter(string(contents), job.To, reason, sj.Attempts); derr != nil {
+			llog.Error("error storing dead letter", kv, llog.ErrKV(derr))
+		}
+		return true
+	}
+
+	if id != "" {
+		// the next attempt stores the emailID again, with the same ID, when
+		// it's sent
+		rerr := removeEmailID(id)
+		if rerr != nil {
+			llog.Error("error deleting failed emailID", llog.KV{"id": id}, llog.ErrKV(rerr))
+		}
+	}
+
+	contents, merr := json.Marshal(sj)
+	if merr != nil {
+		llog.Error("error json encoding failed send job", kv, llog.ErrKV(merr))
+		return false
+	}
+	delay := retryDelay(sj.Attempts)
+	if _, derr := deferJob(queue, string(contents), time.Now().Add(delay)); derr != nil {
+		llog.Error("error deferring failed send job", kv, llog.ErrKV(derr))
+		return false
+	}
+	kv["retryIn"] = delay.String()
+	llog.Warn("error calling sender.Send, retrying", kv, llog.ErrKV(err))
+	return true
+}
 
-		llog.Error("error calling sender.Send", llog.KV{"jobContents": jobContents, "id": id}, llog.ErrKV(err))
+// deferSendJob holds onto the job for d before putting it back in queue without
+// using up an attempt
+func deferSendJob(sj *sendJob, queue string, d time.Duration, reason string) bool {
+	kv := llog.KV{"recipient": sj.To, "deferFor": d.String(), "reason": reason}
+	// sj can always be marshaled since it was just unmarshaled
+	contents, _ := json.Marshal(sj)
+	if _, err := deferJob(queue, string(contents), time.Now().Add(d)); err != nil {
+		llog.Error("error deferring send job", kv, llog.ErrKV(err))
 		return false
 	}
+	llog.Info("deferred send job", kv)
 	return true
 }
 
@@ -152,6 +440,24 @@ func logMarkError(err error, kv llog.KV) {
 	}
 }
 
+// storeUnsubscribe stops the recipient from being sent any more emails with
+// the flags of the email they unsubscribed from
+func storeUnsubscribe(job *StatsJob, kv llog.KV) {
+	doc, err := GetStats(job.StatsID)
+	if err != nil {
+		llog.Error("error getting stats of unsubscribed email", kv, llog.ErrKV(err))
+		return
+	}
+	if doc.EmailFlags == 0 {
+		llog.Warn("unsubscribed from email without flags", kv)
+		return
+	}
+	kv["flags"] = doc.EmailFlags
+	if err = AddEmailFlags(job.Email, doc.EmailFlags); err != nil {
+		llog.Error("error storing unsubscribe flags", kv, llog.ErrKV(err))
+	}
+}
+
 func storeStats(jobContents string) bool {
 	job := new(StatsJob)
 	err := json.Unmarshal([]byte(jobContents), job)
@@ -170,36 +476,107 @@ func storeStats(jobContents string) bool {
 		"reason": job.Reason,
 		"email":  job.Email,
 	}
+	var claimed bool
+	if job.EventID != "" {
+		kv["eventID"] = job.EventID
+		ok, err := claimWebhookEvent(job.EventID)
+		if err != nil {
+			// it's better to risk applying the event twice than to lose it
+			llog.Error("error claiming webhook event", kv, llog.ErrKV(err))
+		} else if !ok {
+			llog.Info("skipping duplicate stats job", kv)
+			return true
+		}
+		claimed = ok
+	}
 	llog.Info("processing stats job", kv)
+	ev := newStatEvent(job)
 	switch job.Type {
 	case "delivered":
-		err = MarkAsDelivered(job.StatsID)
+		err = MarkAsDelivered(job.StatsID, ev)
 		logMarkError(err, kv)
 	case "open":
-		err = MarkAsOpened(job.StatsID)
+		err = MarkAsOpened(job.StatsID, ev)
+		logMarkError(err, kv)
+	case "click":
+		err = MarkAsClicked(job.StatsID, ev)
 		logMarkError(err, kv)
+	case "processed":
+		err = MarkAsProcessed(job.StatsID, ev)
+		logMarkError(err, kv)
+	case "deferred":
+		err = MarkAsDeferred(job.StatsID, job.Reason, ev)
+		logMarkError(err, kv)
+	case "unsubscribe", "group_unsubscribe":
+		err = MarkAsUnsubscribed(job.StatsID, ev)
+		logMarkError(err, kv)
+		if markRetryable(job.StatsID, err) {
+			break
+		}
+		storeUnsubscribe(job, kv)
 	case "bounce":
-		err = MarkAsBounced(job.StatsID, job.Reason)
+		b := classifyBounce(job.Reason, job.BounceType)
+		if b == nil {
+			// providers only send bounces once they've given up on the email
+			b = &Bounce{Class: BounceHard}
+		}
+		kv["bounceClass"] = b.Class
+		err = MarkAsBounced(job.StatsID, job.Reason, b, ev)
 		logMarkError(err, kv)
+		// the rest is done when the job is retried
+		if markRetryable(job.StatsID, err) {
+			break
+		}
 
-		err = StoreEmailBounce(job.Email)
-		if err != nil {
+		if err := StoreEmailBounce(job.Email, b, ev.Timestamp.Time); err != nil {
 			llog.Error("error storing email as bounced", kv, llog.ErrKV(err))
 		}
 	case "spamreport":
-		err = MarkAsSpamReported(job.StatsID)
+		err = MarkAsSpamReported(job.StatsID, ev)
 		logMarkError(err, kv)
+		if markRetryable(job.StatsID, err) {
+			break
+		}
 
-		err = StoreEmailSpam(job.Email)
-		if err != nil {
+		if err := StoreEmailSpam(job.Email, ev.Timestamp.Time); err != nil {
 			llog.Error("error storing email as spamed", kv, llog.ErrKV(err))
 		}
 	case "dropped":
-		//depending on the reason we should mark the email as invalid
-		err = MarkAsDropped(job.StatsID, job.Reason)
+		// drops are only bounces if the reason was because of the address
+		b := classifyBounce(job.Reason, "")
+		err = MarkAsDropped(job.StatsID, job.Reason, b, ev)
 		logMarkError(err, kv)
+		if markRetryable(job.StatsID, err) {
+			break
+		}
+
+		if b != nil {
+			kv["bounceClass"] = b.Class
+			if err := StoreEmailBounce(job.Email, b, ev.Timestamp.Time); err != nil {
+				llog.Error("error storing email as bounced", kv, llog.ErrKV(err))
+			}
+		}
 	default:
 		llog.Warn("received unknown job type", llog.KV{"type": job.Type})
 	}
+
+	// err is only from marking the email, and if that failed the event wasn't
+	// applied. Leave the job in the queue so it's tried again, which means its
+	// claim has to be given back so it isn't skipped as a duplicate
+	if markRetryable(job.StatsID, err) {
+		if claimed {
+			if err := releaseWebhookEvent(job.EventID); err != nil {
+				llog.Error("error releasing webhook event", kv, llog.ErrKV(err))
+			}
+		}
+		return false
+	}
 	return true
 }
+
+// markRetryable returns whether marking the email with the given ID failed with
+// err in a way that could succeed if it's tried again. Emails that don't exist,
+// or IDs that aren't valid, never will
+func markRetryable(id string, err error) bool {
+	return err != nil && err != mgo.ErrNotFound && err != MongoDisabledErr && bson.IsObjectIdHex(id)
+}
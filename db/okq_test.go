@@ -1,15 +1,21 @@
 package db
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	. "testing"
 	"time"
 
 	"github.com/levenlabs/golib/testutil"
+	"github.com/levenlabs/golib/timeutil"
 	"github.com/levenlabs/postmaster/ga"
+	"github.com/levenlabs/postmaster/sender"
 	"github.com/mediocregopher/radix.v2/redis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var okqAddr string
@@ -29,7 +35,7 @@ func TestStoreSendJob(t *T) {
 	}()
 	normalQueue = fmt.Sprintf("%s", testutil.RandStr())
 
-	err := StoreSendJob("hello")
+	err := StoreSendJob("hello", "")
 	require.Nil(t, err)
 
 	r, err := redis.DialTimeout("tcp", okqAddr, 5*time.Second)
@@ -44,6 +50,24 @@ func TestStoreSendJob(t *T) {
 	assert.Equal(t, "hello", cont)
 }
 
+func TestSendQueue(t *T) {
+	assert.Equal(t, highQueue, sendQueue(sender.PriorityHigh))
+	assert.Equal(t, normalQueue, sendQueue(sender.PriorityNormal))
+	assert.Equal(t, lowQueue, sendQueue(sender.PriorityLow))
+	assert.Equal(t, normalQueue, sendQueue(""))
+}
+
+func TestParseQueueWorkers(t *T) {
+	m, err := parseQueueWorkers("email-high=4, email-normal=8")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]int{"email-high": 4, "email-normal": 8}, m)
+
+	_, err = parseQueueWorkers("email-high")
+	assert.NotNil(t, err)
+	_, err = parseQueueWorkers("email-high=0")
+	assert.NotNil(t, err)
+}
+
 func TestStoreStatsJob(t *T) {
 	require.True(t, useOkq)
 	// randomize the queue so the consumer that's consuming jobs doesn't pick
@@ -68,3 +92,183 @@ func TestStoreStatsJob(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, "hello2", cont)
 }
+
+func TestStoreStatsDuplicate(t *T) {
+	require.False(t, mongoDisabled)
+	id := GenerateEmailID("test@test.com", 0, "", "production")
+	require.NotEmpty(t, id)
+
+	job := fmt.Sprintf(`{"email":"test@test.com","event":"open","pmStatsID":"%s","pmEnvID":"production","sg_event_id":"%s"}`, id, testutil.RandStr())
+	assert.True(t, storeStats(job))
+	// the provider retried the webhook
+	assert.True(t, storeStats(job))
+
+	events, err := GetStatEvents(id)
+	require.Nil(t, err)
+	assert.Len(t, events, 1)
+
+	// events without an ID can't be deduped
+	job = fmt.Sprintf(`{"email":"test@test.com","event":"click","pmStatsID":"%s","pmEnvID":"production"}`, id)
+	assert.True(t, storeStats(job))
+	assert.True(t, storeStats(job))
+
+	events, err = GetStatEvents(id)
+	require.Nil(t, err)
+	assert.Len(t, events, 3)
+}
+
+func TestStoreStatsInvalid(t *T) {
+	require.False(t, mongoDisabled)
+
+	// marking an email that doesn't exist will never work so the job isn't
+	// retried
+	job := fmt.Sprintf(`{"email":"test@test.com","event":"open","pmStatsID":"invalid","pmEnvID":"production","sg_event_id":"%s"}`, testutil.RandStr())
+	assert.True(t, storeStats(job))
+	job = fmt.Sprintf(`{"email":"test@test.com","event":"open","pmStatsID":"%s","pmEnvID":"production","sg_event_id":"%s"}`, bson.NewObjectId().Hex(), testutil.RandStr())
+	assert.True(t, storeStats(job))
+}
+
+func TestMarkRetryable(t *T) {
+	id := bson.NewObjectId().Hex()
+	assert.False(t, markRetryable(id, nil))
+	assert.False(t, markRetryable(id, mgo.ErrNotFound))
+	assert.False(t, markRetryable("invalid", errors.New("invalid id")))
+	assert.True(t, markRetryable(id, errors.New("connection reset")))
+}
+
+func TestRetryDelay(t *T) {
+	for i := 1; i < 12; i++ {
+		max := retryBackoff << uint(i-1)
+		if max > maxRetryBackoff {
+			max = maxRetryBackoff
+		}
+		d := retryDelay(i)
+		assert.True(t, d >= max/2, "attempt %d: %s < %s", i, d, max/2)
+		assert.True(t, d <= max, "attempt %d: %s > %s", i, d, max)
+	}
+}
+
+func TestDomainDelay(t *T) {
+	defer func(m map[string]*domainLimit) { domainLimits = m }(domainLimits)
+	var err error
+	domainLimits, err = parseDomainRates("Gmail.com=60")
+	require.Nil(t, err)
+
+	assert.Equal(t, time.Duration(0), domainDelay("a@gmail.com"))
+	// the next slot is a second later, and the one after that is another
+	// second later
+	d := domainDelay("b@GMAIL.com")
+	assert.True(t, d > 900*time.Millisecond && d <= time.Second, "%s", d)
+	d = domainDelay("c@gmail.com")
+	assert.True(t, d > 1900*time.Millisecond && d <= 2*time.Second, "%s", d)
+
+	// giving back the last slot lets the next email have it
+	releaseDomainDelay("c@gmail.com")
+	d = domainDelay("d@gmail.com")
+	assert.True(t, d > 1900*time.Millisecond && d <= 2*time.Second, "%s", d)
+
+	// other domains aren't limited
+	assert.Equal(t, time.Duration(0), domainDelay("a@yahoo.com"))
+	assert.Equal(t, time.Duration(0), domainDelay("a@yahoo.com"))
+	releaseDomainDelay("a@yahoo.com")
+
+	_, err = parseDomainRates("gmail.com=0")
+	assert.NotNil(t, err)
+}
+
+func TestWarmupLimit(t *T) {
+	defer func(s, tv, d int) {
+		warmupStartVolume, warmupTargetVolume, warmupDays = s, tv, d
+	}(warmupStartVolume, warmupTargetVolume, warmupDays)
+	warmupStartVolume, warmupTargetVolume, warmupDays = 50, 5000, 10
+
+	assert.Equal(t, 50, warmupLimit(-1))
+	assert.Equal(t, 50, warmupLimit(0))
+	assert.Equal(t, 500, warmupLimit(5))
+	assert.True(t, warmupLimit(9) > warmupLimit(8))
+	assert.Equal(t, -1, warmupLimit(10))
+
+	m, err := parseWarmupRoutes("sendgrid:pool=2016-01-02, default=2016-02-01")
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC), m["sendgrid:pool"])
+	assert.Len(t, m, 2)
+	_, err = parseWarmupRoutes("sendgrid:pool=yesterday")
+	assert.NotNil(t, err)
+}
+
+func TestWarmupDelay(t *T) {
+	require.False(t, mongoDisabled)
+	defer func(m map[string]time.Time, s int) {
+		warmupStarts, warmupStartVolume = m, s
+	}(warmupStarts, warmupStartVolume)
+	route := testutil.RandStr()
+	warmupStarts = map[string]time.Time{route: time.Now().UTC()}
+	warmupStartVolume = 2
+
+	for i := 0; i < 2; i++ {
+		d, err := warmupDelay(route)
+		require.Nil(t, err)
+		assert.Equal(t, time.Duration(0), d)
+		require.NotEmpty(t, generateEmailID(&StatDoc{Recipient: "test@test.com", Route: route}))
+	}
+
+	// today's limit has been reached so it has to wait until tomorrow
+	d, err := warmupDelay(route)
+	require.Nil(t, err)
+	assert.True(t, d > 0 && d <= 25*time.Hour, "%s", d)
+
+	// routes which aren't warming up are never held back
+	d, err = warmupDelay(testutil.RandStr())
+	require.Nil(t, err)
+	assert.Equal(t, time.Duration(0), d)
+}
+
+func TestSendEmailPrefsChanged(t *T) {
+	require.False(t, mongoDisabled)
+	email := testutil.RandStr() + "@test.com"
+	job := &sender.Mail{
+		To:      email,
+		From:    "from@test.com",
+		Subject: "Test",
+		Text:    "hey",
+		Flags:   4 | 8,
+	}
+	id := AssignStatsID(job)
+	require.NotEmpty(t, id)
+	contents, err := json.Marshal(job)
+	require.Nil(t, err)
+
+	// the recipient unsubscribed after the email was enqueued
+	require.Nil(t, StoreEmailFlags(email, 4))
+	assert.True(t, sendEmail(string(contents)))
+
+	doc, err := GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(Suppressed), doc.StateFlags)
+	assert.Equal(t, SuppressedPrefs, doc.Error)
+}
+
+func TestSendEmailExpired(t *T) {
+	require.False(t, mongoDisabled)
+	job := &sender.Mail{
+		To:        testutil.RandStr() + "@test.com",
+		From:      "from@test.com",
+		Subject:   "Test",
+		Text:      "hey",
+		ExpiresAt: &timeutil.Timestamp{Time: time.Now().Add(-time.Second)},
+	}
+	start := time.Now()
+	id := AssignStatsID(job)
+	contents, err := json.Marshal(job)
+	require.Nil(t, err)
+	assert.True(t, sendEmail(string(contents)))
+
+	doc, err := GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(Expired), doc.StateFlags)
+
+	counts, err := CountStates(start.Add(-time.Second), time.Now().Add(time.Second))
+	require.Nil(t, err)
+	assert.True(t, counts["expired"] >= 1)
+	assert.True(t, counts["total"] >= counts["expired"])
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// countWindow is a single key:count/window in a spec such as --frequency-caps
+// or --suppression-policies
+type countWindow struct {
+	key    string
+	count  int
+	window time.Duration
+}
+
+// parseCountWindows parses a spec in the form of key:count/window,... into its
+// parts in the same order. what names a part in the returned errors. The keys
+// aren't checked, that's left to the caller
+func parseCountWindows(spec, what string) ([]countWindow, error) {
+	var cws []countWindow
+	if strings.TrimSpace(spec) == "" {
+		return cws, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.Index(part, ":")
+		j := strings.Index(part, "/")
+		if i < 0 || j < i {
+			return nil, fmt.Errorf("invalid %s %q", what, part)
+		}
+		cw := countWindow{key: part[:i]}
+		var err error
+		if cw.count, err = strconv.Atoi(part[i+1 : j]); err != nil || cw.count < 1 {
+			return nil, fmt.Errorf("invalid count for %s %q", what, part)
+		}
+		if cw.window, err = time.ParseDuration(part[j+1:]); err != nil || cw.window <= 0 {
+			return nil, fmt.Errorf("invalid window for %s %q", what, part)
+		}
+		cws = append(cws, cw)
+	}
+	return cws, nil
+}
@@ -4,10 +4,12 @@ import (
 	"time"
 
 	"fmt"
+	"unicode/utf8"
 
 	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/golib/rpcutil"
 	"github.com/levenlabs/golib/timeutil"
+	"github.com/levenlabs/postmaster/sender"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -19,6 +21,13 @@ const (
 	Bounced
 	Dropped
 	Opened
+	Failed
+	Suppressed
+	Expired
+	Clicked
+	Deferred
+	Processed
+	Unsubscribed
 )
 
 // A StatsJob encompasses a okq job in response to a webhook event and is used
@@ -29,7 +38,8 @@ type StatsJob struct {
 
 	Timestamp timeutil.Timestamp `json:"timestamp,omitempty"`
 
-	//Type is one of: bounce, deferred, delivered, dropped, processed
+	//Type is one of: bounce, click, deferred, delivered, dropped, group_unsubscribe,
+	//open, processed, spamreport, unsubscribe
 	Type string `json:"event" validate:"nonzero"`
 
 	//json flag must match db.uniqueArgStatID in okq.go
@@ -43,13 +53,85 @@ type StatsJob struct {
 
 	// Reason is miscellaneous data for why it bounced, dropped, etc
 	Reason string `json:"reason,omitempty" validate:"max=1024"`
+
+	// BounceType is sent with bounce events and is either bounce or blocked
+	BounceType string `json:"type,omitempty" validate:"max=32"`
+
+	// IP and UserAgent are of the recipient and are sent with open and click
+	// events
+	IP        string `json:"ip,omitempty" validate:"max=64"`
+	UserAgent string `json:"useragent,omitempty" validate:"max=1024"`
+
+	// URL is the link which was clicked and is sent with click events. Call
+	// Truncate before validating so long ones don't fail validation
+	URL string `json:"url,omitempty" validate:"max=2048"`
+
+	// EventID is the provider's unique ID for the event, which is used to
+	// skip events the provider sent more than once
+	EventID string `json:"sg_event_id,omitempty" validate:"max=256"`
+}
+
+// maxUserAgent and maxURL are the most characters kept of a StatsJob's
+// UserAgent and URL and must match their validate tags
+const (
+	maxUserAgent = 1024
+	maxURL       = 2048
+)
+
+// Truncate shortens the UserAgent and URL to the most that's kept of them.
+// They can be arbitrarily long and are only informational, so it's better to
+// keep the start of them than to drop the whole event
+func (s *StatsJob) Truncate() {
+	s.UserAgent = truncateString(s.UserAgent, maxUserAgent)
+	s.URL = truncateString(s.URL, maxURL)
+}
+
+// truncateString returns the first n characters of s
+func truncateString(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// A StatEvent is a single webhook event for an email, kept in the email's
+// StatDoc in the order the provider said they happened
+type StatEvent struct {
+	// Type is the StatsJob's Type
+	Type string `json:"type" bson:"t"`
+
+	// Timestamp is when the provider said the event happened
+	Timestamp timeutil.Timestamp `json:"timestamp" bson:"ts"`
+
+	Reason    string `json:"reason,omitempty" bson:"r,omitempty"`
+	IP        string `json:"ip,omitempty" bson:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty" bson:"ua,omitempty"`
+	URL       string `json:"url,omitempty" bson:"url,omitempty"`
+}
+
+// newStatEvent returns the StatEvent for the job
+func newStatEvent(job *StatsJob) *StatEvent {
+	return &StatEvent{
+		Type:      job.Type,
+		Timestamp: job.Timestamp,
+		Reason:    job.Reason,
+		IP:        job.IP,
+		UserAgent: job.UserAgent,
+		URL:       job.URL,
+	}
 }
 
 // A StatDoc represents an email that was sent
 type StatDoc struct {
 	// ID is a unique identifier for this doc not to be confused by the
-	// user-supplied uniqueID field
-	ID bson.ObjectId `json:"-" bson:"_id,omitempty"`
+	// user-supplied uniqueID field. It's the statsID returned from Enqueue
+	ID bson.ObjectId `json:"id" bson:"_id,omitempty"`
 
 	// Recipient is the email address of the recipient
 	Recipient string `json:"recipient" bson:"r"`
@@ -66,41 +148,96 @@ type StatDoc struct {
 	// SentEnvironment was the original environment when sent
 	SentEnvironment string `json:"sentEnv" bson:"se"`
 
+	// Route is the name of the sender.Route the email was sent through
+	Route string `json:"route,omitempty" bson:"rt,omitempty"`
+
 	// TSCreated is the time that the email was sent
 	TSCreated timeutil.Timestamp `json:"tsCreated" bson:"tc"`
 
-	// TSUpdated is the last time this doc was updated
+	// TSUpdated is the time of the latest event for the email, as given by the
+	// provider. Events which arrive out of order don't move it back
 	TSUpdated timeutil.Timestamp `json:"tsUpdated" bson:"ts"`
 
 	// Error is the reason for why the email errored
 	Error string `json:"error" bson:"err,omitempty"`
+
+	// ErrorTS is the time of the event Error came from, so an older event
+	// arriving late doesn't overwrite it
+	ErrorTS timeutil.Timestamp `json:"-" bson:"et,omitempty"`
+
+	// Bounce is the classification of Error if the email bounced or was
+	// dropped because of its address
+	Bounce *Bounce `json:"bounce,omitempty" bson:"bc,omitempty"`
+
+	// Events are the webhook events for the email, in the order the provider
+	// said they happened. Only the latest maxStatEvents are kept. They're fetched
+	// separately with GetStatEvents since there can be a lot of them
+	Events []StatEvent `json:"-" bson:"ev,omitempty"`
 }
 
 func init() {
 	rpcutil.InstallCustomValidators()
 }
 
+// toTS converts t into a Timestamp, which is how the times in docs such as tc
+// are stored, so it's encoded the same way when it's compared against them in
+// queries
+func toTS(t time.Time) timeutil.Timestamp {
+	return timeutil.Timestamp{Time: t}
+}
+
 // GenerateEmailID generates a uniqueID and stores a record of an intended email
-// this is used in okq.go and in tests
+// this is used in tests
 func GenerateEmailID(recipient string, flags int64, uid string, env string) string {
-	if mongoDisabled {
-		return ""
-	}
-	now := timeutil.TimestampNow()
-	doc := &StatDoc{
+	return generateEmailID(&StatDoc{
 		Recipient:       recipient,
 		EmailFlags:      flags,
 		UniqueID:        uid,
 		SentEnvironment: env,
-		TSCreated:       now,
-		TSUpdated:       now,
+	})
+}
+
+// AssignStatsID allocates the ID of the StatDoc which will be stored when the
+// email is sent and stores it in the email's unique args, so it can be known
+// before the email is sent. An empty string is returned if stats aren't being
+// stored
+func AssignStatsID(job *sender.Mail) string {
+	// pmStatsID is reserved so never trust one that was passed in
+	delete(job.UniqueArgs, uniqueArgStatID)
+	if mongoDisabled {
+		return ""
+	}
+	if job.UniqueArgs == nil {
+		job.UniqueArgs = make(map[string]string)
+	}
+	id := bson.NewObjectId().Hex()
+	job.UniqueArgs[uniqueArgStatID] = id
+	return id
+}
+
+// generateEmailID stores the doc and returns its ID. If the doc doesn't have an
+// ID then a new one is generated
+// this is used in okq.go
+func generateEmailID(doc *StatDoc) string {
+	if mongoDisabled {
+		return ""
 	}
+	now := timeutil.TimestampNow()
+	doc.TSCreated = now
+	doc.TSUpdated = now
 	//generate our own ObjectID since mgo doesn't do it for insert
-	doc.ID = bson.NewObjectId()
+	if doc.ID == "" {
+		doc.ID = bson.NewObjectId()
+	}
 	var err error
 	statsSH.WithColl(func(c *mgo.Collection) {
 		err = c.Insert(doc)
 	})
+	if mgo.IsDup(err) {
+		// the job was already being sent when it was put back in its queue, so
+		// the doc is already there
+		return doc.ID.Hex()
+	}
 	if err != nil {
 		llog.Error("error inserting in generateEmailID", llog.KV{"doc": doc}, llog.ErrKV(err))
 		return ""
@@ -118,11 +255,23 @@ func removeEmailID(id string) error {
 	return err
 }
 
+// setEmailRoute changes the route stored for the email with the given ID
+func setEmailRoute(id, route string) error {
+	var err error
+	statsSH.WithColl(func(c *mgo.Collection) {
+		err = c.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"rt": route}})
+	})
+	return err
+}
+
 //this is mostly for testing purposes
 func GetStats(id string) (*StatDoc, error) {
 	if mongoDisabled {
 		return nil, MongoDisabledErr
 	}
+	if !bson.IsObjectIdHex(id) {
+		return nil, mgo.ErrNotFound
+	}
 	var err error
 	doc := &StatDoc{}
 	statsSH.WithColl(func(c *mgo.Collection) {
@@ -136,6 +285,31 @@ func GetStats(id string) (*StatDoc, error) {
 }
 
 func markAs(id string, flag int, reason string) error {
+	return markAsWith(id, flag, reason, nil, nil)
+}
+
+// maxStatEvents is the most events kept for an email. Emails which are opened
+// or clicked over and over would otherwise grow without bound
+const maxStatEvents = 100
+
+// impliedStates are the states which must have happened before each state,
+// even if their events haven't arrived yet. For example an email can't be
+// opened without being delivered first
+var impliedStates = map[int]int{
+	Delivered:    Processed,
+	Opened:       Delivered | Processed,
+	Clicked:      Opened | Delivered | Processed,
+	SpamReported: Delivered | Processed,
+	Unsubscribed: Delivered | Processed,
+	Bounced:      Processed,
+	Deferred:     Processed,
+}
+
+// markAsWith is like markAs but also adds ev to the email's events, which is
+// optional. The time of the update is ev's Timestamp if it has one, so events
+// can be applied in any order. The fields in set go along with reason, and
+// like reason they're only set if there's no newer event with a reason
+func markAsWith(id string, flag int, reason string, set bson.M, ev *StatEvent) error {
 	if mongoDisabled {
 		return MongoDisabledErr
 	}
@@ -144,41 +318,140 @@ func markAs(id string, flag int, reason string) error {
 		return fmt.Errorf("invalid id sent to markAs: %s", id)
 	}
 
-	var set map[string]interface{}
-	if reason != "" {
-		set = bson.M{"ts": time.Now(), "err": reason}
-	} else {
-		set = bson.M{"ts": time.Now()}
+	ts := timeutil.TimestampNow()
+	if ev != nil {
+		if !ev.Timestamp.IsZero() {
+			ts = ev.Timestamp
+		}
+		ev.Timestamp = ts
+	}
+	update := bson.M{
+		"$bit": bson.M{"s": bson.M{"or": flag | impliedStates[flag]}},
+		"$max": bson.M{"ts": ts},
+	}
+	if ev != nil {
+		// keep the events sorted by when they happened rather than when they
+		// arrived, and drop the oldest ones once there's too many
+		update["$push"] = bson.M{"ev": bson.M{
+			"$each":  []*StatEvent{ev},
+			"$sort":  bson.M{"ts": 1},
+			"$slice": -maxStatEvents,
+		}}
 	}
-	update := bson.M{"$bit": bson.M{"s": bson.M{"or": flag}}, "$set": set}
+
+	oid := bson.ObjectIdHex(id)
 	var err error
 	statsSH.WithColl(func(c *mgo.Collection) {
-		err = c.UpdateId(bson.ObjectIdHex(id), update)
+		if reason != "" {
+			if set == nil {
+				set = bson.M{}
+			}
+			set["err"] = reason
+			set["et"] = ts
+			update["$set"] = set
+			q := bson.M{"_id": oid, "$or": []bson.M{
+				{"et": bson.M{"$exists": false}},
+				{"et": bson.M{"$lte": ts}},
+			}}
+			if err = c.Update(q, update); err != mgo.ErrNotFound {
+				return
+			}
+			// there's already a newer reason so only apply the rest
+			delete(update, "$set")
+		}
+		err = c.UpdateId(oid, update)
 	})
 	return err
 }
 
-func MarkAsDelivered(id string) error {
-	return markAs(id, Delivered, "")
+func MarkAsDelivered(id string, ev *StatEvent) error {
+	return markAsWith(id, Delivered, "", nil, ev)
+}
+
+// MarkAsBounced marks that the email bounced. b is the classification of
+// reason and is optional
+func MarkAsBounced(id string, reason string, b *Bounce, ev *StatEvent) error {
+	return markAsWith(id, Bounced, reason, bounceSet(b), ev)
+}
+
+// MarkAsDropped marks that the provider dropped the email. b is the
+// classification of reason and is optional
+func MarkAsDropped(id string, reason string, b *Bounce, ev *StatEvent) error {
+	return markAsWith(id, Dropped, reason, bounceSet(b), ev)
+}
+
+func bounceSet(b *Bounce) bson.M {
+	if b == nil {
+		return nil
+	}
+	return bson.M{"bc": b}
 }
 
-func MarkAsBounced(id string, reason string) error {
-	return markAs(id, Bounced, reason)
+func MarkAsSpamReported(id string, ev *StatEvent) error {
+	return markAsWith(id, SpamReported, "", nil, ev)
 }
 
-func MarkAsDropped(id string, reason string) error {
-	return markAs(id, Dropped, reason)
+func MarkAsOpened(id string, ev *StatEvent) error {
+	return markAsWith(id, Opened, "", nil, ev)
 }
 
-func MarkAsSpamReported(id string) error {
-	return markAs(id, SpamReported, "")
+// MarkAsClicked marks that a link in the email was clicked
+func MarkAsClicked(id string, ev *StatEvent) error {
+	return markAsWith(id, Clicked, "", nil, ev)
 }
 
-func MarkAsOpened(id string) error {
-	return markAs(id, Opened, "")
+// MarkAsDeferred marks that the receiving server temporarily rejected the
+// email and the provider is going to try again
+func MarkAsDeferred(id string, reason string, ev *StatEvent) error {
+	return markAsWith(id, Deferred, reason, nil, ev)
+}
+
+// MarkAsProcessed marks that the provider accepted the email and is going to
+// deliver it
+func MarkAsProcessed(id string, ev *StatEvent) error {
+	return markAsWith(id, Processed, "", nil, ev)
+}
+
+// MarkAsUnsubscribed marks that the recipient unsubscribed using the email
+func MarkAsUnsubscribed(id string, ev *StatEvent) error {
+	return markAsWith(id, Unsubscribed, "", nil, ev)
+}
+
+// MarkAsFailed marks that the email couldn't be sent, either because the
+// provider rejected it or because we gave up retrying it
+func MarkAsFailed(id string, reason string) error {
+	return markAs(id, Failed, reason)
+}
+
+// GetStatEvents returns the events of the email with the given ID in the order
+// the provider said they happened
+func GetStatEvents(id string) ([]StatEvent, error) {
+	if mongoDisabled {
+		return nil, MongoDisabledErr
+	}
+	if !bson.IsObjectIdHex(id) {
+		return nil, mgo.ErrNotFound
+	}
+	var err error
+	doc := &StatDoc{}
+	statsSH.WithColl(func(c *mgo.Collection) {
+		err = c.FindId(bson.ObjectIdHex(id)).Select(bson.M{"ev": 1}).One(doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if doc.Events == nil {
+		doc.Events = []StatEvent{}
+	}
+	return doc.Events, nil
 }
 
-// GetLastUniqueID gets the last StatDoc for the given recipient and uniqueID
+// unsentStates are the states of emails which were never sent, whose stats are
+// only stored so their statsID can be looked up
+const unsentStates = Suppressed | Expired | Failed
+
+// GetLastUniqueID gets the last StatDoc of an email which was sent to the given
+// recipient with the uniqueID
 func GetLastUniqueID(recipient, uid string) (*StatDoc, error) {
 	if mongoDisabled {
 		return nil, MongoDisabledErr
@@ -189,6 +462,7 @@ func GetLastUniqueID(recipient, uid string) (*StatDoc, error) {
 		q := bson.M{
 			"uid": uid,
 			"r":   recipient,
+			"s":   bson.M{"$bitsAllClear": unsentStates},
 		}
 		// sort by the highest (newest) created times at top
 		err = c.Find(q).Sort("-tc").One(doc)
@@ -198,3 +472,49 @@ func GetLastUniqueID(recipient, uid string) (*StatDoc, error) {
 	}
 	return doc, err
 }
+
+// stateNames are the names of each state as returned from CountStates
+var stateNames = map[int]string{
+	Delivered:    "delivered",
+	SpamReported: "spamReported",
+	Bounced:      "bounced",
+	Dropped:      "dropped",
+	Opened:       "opened",
+	Clicked:      "clicked",
+	Deferred:     "deferred",
+	Processed:    "processed",
+	Unsubscribed: "unsubscribed",
+	Failed:       "failed",
+	Suppressed:   "suppressed",
+	Expired:      "expired",
+}
+
+// CountStates returns how many emails created between since and until are in
+// each state, keyed by the state's name, along with the total number of emails
+// as total
+func CountStates(since, until time.Time) (map[string]int, error) {
+	if mongoDisabled {
+		return nil, MongoDisabledErr
+	}
+	q := bson.M{"tc": bson.M{
+		"$gte": toTS(since),
+		"$lt":  toTS(until),
+	}}
+	counts := map[string]int{}
+	var err error
+	statsSH.WithColl(func(c *mgo.Collection) {
+		if counts["total"], err = c.Find(q).Count(); err != nil {
+			return
+		}
+		for state, name := range stateNames {
+			q["s"] = bson.M{"$bitsAllSet": state}
+			if counts[name], err = c.Find(q).Count(); err != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -3,9 +3,13 @@ package db
 import (
 	"github.com/levenlabs/golib/testutil"
 	"github.com/levenlabs/golib/timeutil"
+	"github.com/levenlabs/postmaster/sender"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/validator.v2"
+	"strings"
 	. "testing"
 	"time"
 )
@@ -50,6 +54,56 @@ func TestMarkAs(t *T) {
 	assert.Equal(t, "Test", doc.Error)
 }
 
+func TestMarkAsOutOfOrder(t *T) {
+	require.False(t, mongoDisabled)
+	id := GenerateEmailID("test@test", 0, "", "production")
+	require.NotEmpty(t, id)
+
+	now := time.Now().Truncate(time.Second)
+	at := func(d time.Duration) *StatEvent {
+		return &StatEvent{Timestamp: timeutil.Timestamp{Time: now.Add(d)}}
+	}
+
+	// the open arrives before the delivered, and the deferral arrives after
+	// the bounce
+	require.Nil(t, MarkAsOpened(id, at(10*time.Second)))
+	require.Nil(t, MarkAsDelivered(id, at(5*time.Second)))
+	require.Nil(t, MarkAsBounced(id, "bounced", nil, at(20*time.Second)))
+	require.Nil(t, MarkAsDeferred(id, "deferred", at(time.Second)))
+
+	doc, err := GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(Opened|Delivered|Processed|Bounced|Deferred), doc.StateFlags)
+	assert.Equal(t, now.Add(20*time.Second).Unix(), doc.TSUpdated.Unix())
+	assert.Equal(t, "bounced", doc.Error)
+
+	events, err := GetStatEvents(id)
+	require.Nil(t, err)
+	require.Len(t, events, 4)
+	for i, d := range []time.Duration{time.Second, 5 * time.Second, 10 * time.Second, 20 * time.Second} {
+		assert.Equal(t, now.Add(d).Unix(), events[i].Timestamp.Unix())
+	}
+}
+
+func TestStatEventsCapped(t *T) {
+	require.False(t, mongoDisabled)
+	id := GenerateEmailID("test@test", 0, "", "production")
+	require.NotEmpty(t, id)
+	now := time.Now().Truncate(time.Second)
+
+	for i := 0; i < maxStatEvents+5; i++ {
+		ev := &StatEvent{Timestamp: timeutil.Timestamp{Time: now.Add(time.Duration(i) * time.Second)}}
+		require.Nil(t, MarkAsOpened(id, ev))
+	}
+
+	// only the latest events are kept
+	events, err := GetStatEvents(id)
+	require.Nil(t, err)
+	require.Len(t, events, maxStatEvents)
+	assert.Equal(t, now.Add(5*time.Second).Unix(), events[0].Timestamp.Unix())
+	assert.Equal(t, now.Add((maxStatEvents+4)*time.Second).Unix(), events[maxStatEvents-1].Timestamp.Unix())
+}
+
 func TestValidation(t *T) {
 	require.False(t, mongoDisabled)
 	s := &StatsJob{}
@@ -95,6 +149,23 @@ func TestValidation(t *T) {
 		StatsID:   testutil.RandStr(),
 	}
 	assert.NotNil(t, validator.Validate(s))
+
+	// long user agents and urls are truncated rather than failing
+	s = &StatsJob{
+		Email:           "fake@test",
+		Timestamp:       timeutil.TimestampNow(),
+		Type:            "click",
+		StatsID:         testutil.RandStr(),
+		SentEnvironment: "production",
+		UserAgent:       strings.Repeat("é", maxUserAgent+1),
+		URL:             "https://test.com/?" + strings.Repeat("a", maxURL),
+	}
+	assert.NotNil(t, validator.Validate(s))
+	s.Truncate()
+	assert.Nil(t, validator.Validate(s))
+	assert.Equal(t, strings.Repeat("é", maxUserAgent), s.UserAgent)
+	assert.Len(t, s.URL, maxURL)
+	assert.True(t, strings.HasPrefix(s.URL, "https://test.com/?a"))
 }
 
 func TestGetLastUniqueID(t *T) {
@@ -119,4 +190,56 @@ func TestGetLastUniqueID(t *T) {
 	doc, err = GetLastUniqueID(email, "hey")
 	require.Nil(t, err)
 	assert.Equal(t, id, doc.ID.Hex())
+
+	time.Sleep(2 * time.Second)
+
+	// emails which were never sent don't count
+	job := &sender.Mail{To: email, Flags: 1, UniqueID: "hey"}
+	require.NotEmpty(t, SuppressEmail(job, SuppressedFrequencyCap))
+
+	doc, err = GetLastUniqueID(email, "hey")
+	require.Nil(t, err)
+	assert.Equal(t, id, doc.ID.Hex())
+}
+
+func TestGenerateEmailIDRoute(t *T) {
+	require.False(t, mongoDisabled)
+	id := generateEmailID(&StatDoc{
+		Recipient:  "test@test",
+		EmailFlags: 2,
+		Route:      "sendgrid:transactional",
+	})
+	require.NotEmpty(t, id)
+
+	doc, err := GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, "sendgrid:transactional", doc.Route)
+	assert.False(t, doc.TSCreated.IsZero())
+}
+
+func TestAssignStatsID(t *T) {
+	require.False(t, mongoDisabled)
+	job := &sender.Mail{
+		To:         "test@test",
+		UniqueArgs: map[string]string{uniqueArgStatID: "fake"},
+	}
+	id := AssignStatsID(job)
+	require.NotEmpty(t, id)
+	assert.NotEqual(t, "fake", id)
+	assert.Equal(t, id, job.UniqueArgs[uniqueArgStatID])
+
+	// nothing is stored until the email is sent
+	_, err := GetStats(id)
+	assert.Equal(t, mgo.ErrNotFound, err)
+
+	doc := &StatDoc{Recipient: job.To, ID: bson.ObjectIdHex(id)}
+	assert.Equal(t, id, generateEmailID(doc))
+	// storing it again doesn't fail
+	assert.Equal(t, id, generateEmailID(doc))
+	doc, err = GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, "test@test", doc.Recipient)
+
+	_, err = GetStats("nope")
+	assert.Equal(t, mgo.ErrNotFound, err)
 }
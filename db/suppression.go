@@ -0,0 +1,172 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The reasons an address can be suppressed for
+const (
+	SuppressionBounce     = "bounce"
+	SuppressionHardBounce = "hardbounce"
+	SuppressionSoftBounce = "softbounce"
+	SuppressionBlock      = "block"
+	SuppressionSpam       = "spam"
+)
+
+// suppressionFields are the fields in EmailDoc holding the times of the events
+// of each kind
+var suppressionFields = map[string]string{
+	SuppressionBounce:     "b",
+	SuppressionHardBounce: "hb",
+	SuppressionSoftBounce: "sb",
+	SuppressionBlock:      "bk",
+	SuppressionSpam:       "s",
+}
+
+// suppressionEvents returns the times of the doc's events of kind
+func suppressionEvents(doc *EmailDoc, kind string) []time.Time {
+	switch kind {
+	case SuppressionHardBounce:
+		return doc.HardBounces
+	case SuppressionSoftBounce:
+		return doc.SoftBounces
+	case SuppressionBlock:
+		return doc.Blocks
+	case SuppressionSpam:
+		return doc.SpamReports
+	}
+	return doc.Bounces
+}
+
+// suppressionPolicy suppresses an address once it has count events of kind
+// within window
+type suppressionPolicy struct {
+	kind   string
+	count  int
+	window time.Duration
+}
+
+// suppressionPolicies are the policies from --suppression-policies
+var suppressionPolicies []suppressionPolicy
+
+// parseSuppressionPolicies parses a spec in the form of kind:count/window,...
+// such as spam:1/8760h,bounce:2/720h
+func parseSuppressionPolicies(spec string) ([]suppressionPolicy, error) {
+	cws, err := parseCountWindows(spec, "suppression policy")
+	if err != nil {
+		return nil, err
+	}
+	var ps []suppressionPolicy
+	for _, cw := range cws {
+		if _, ok := suppressionFields[cw.key]; !ok {
+			return nil, fmt.Errorf("invalid kind for suppression policy %q", cw.key)
+		}
+		ps = append(ps, suppressionPolicy{kind: cw.key, count: cw.count, window: cw.window})
+	}
+	return ps, nil
+}
+
+// suppressionReason returns why the address of the doc is suppressed by the
+// --suppression-policies, or an empty string if it isn't. Events from before
+// the doc's suppressions were cleared don't count
+func suppressionReason(doc *EmailDoc, now time.Time) string {
+	for _, p := range suppressionPolicies {
+		events := suppressionEvents(doc, p.kind)
+		since := now.Add(-p.window)
+		if doc.SuppressionsCleared.After(since) {
+			since = doc.SuppressionsCleared
+		}
+		var n int
+		for _, t := range events {
+			if t.After(since) {
+				n++
+			}
+		}
+		if n >= p.count {
+			return p.kind
+		}
+	}
+	return ""
+}
+
+// Suppression is an address which isn't being sent to because of the
+// --suppression-policies
+type Suppression struct {
+	Email string `json:"email"`
+
+	// Reason is the kind of the policy which suppressed the address, one of
+	// bounce, hardbounce, softbounce, block or spam
+	Reason string `json:"reason"`
+
+	// LastBounce is the classification of the address's most recent bounce
+	LastBounce *Bounce `json:"lastBounce,omitempty"`
+
+	Bounces     []time.Time `json:"bounces"`
+	SpamReports []time.Time `json:"spamReports"`
+	TSUpdated   time.Time   `json:"tsUpdated"`
+}
+
+// ListSuppressions returns up to limit of the most recently updated addresses
+// which are suppressed
+func ListSuppressions(limit int) ([]Suppression, error) {
+	if mongoDisabled {
+		return nil, MongoDisabledErr
+	}
+	ss := []Suppression{}
+	if len(suppressionPolicies) == 0 {
+		return ss, nil
+	}
+
+	// only look at the docs which have enough events for any of the policies
+	// to apply, the windows are checked in suppressionReason
+	or := make([]bson.M, len(suppressionPolicies))
+	for i, p := range suppressionPolicies {
+		field := fmt.Sprintf("%s.%d", suppressionFields[p.kind], p.count-1)
+		or[i] = bson.M{field: bson.M{"$exists": true}}
+	}
+
+	now := time.Now()
+	var err error
+	emailSH.WithColl(func(c *mgo.Collection) {
+		iter := c.Find(bson.M{"$or": or}).Sort("-ts").Iter()
+		var doc EmailDoc
+		for len(ss) < limit && iter.Next(&doc) {
+			if reason := suppressionReason(&doc, now); reason != "" {
+				ss = append(ss, Suppression{
+					Email:       doc.Email,
+					Reason:      reason,
+					LastBounce:  doc.LastBounce,
+					Bounces:     doc.Bounces,
+					SpamReports: doc.SpamReports,
+					TSUpdated:   doc.TSUpdated,
+				})
+			}
+			doc = EmailDoc{}
+		}
+		err = iter.Close()
+	})
+	return ss, err
+}
+
+// ClearSuppression clears the suppression of the address so it can be sent to
+// again. Its bounces and spam reports are kept, but the ones from before now
+// no longer count towards the --suppression-policies
+func ClearSuppression(email string) error {
+	if mongoDisabled {
+		return MongoDisabledErr
+	}
+	n := time.Now()
+	var err error
+	emailSH.WithColl(func(c *mgo.Collection) {
+		err = c.UpdateId(email, bson.M{"$set": bson.M{"sc": n, "ts": n}})
+	})
+	if err == mgo.ErrNotFound {
+		// if there's no doc then there's nothing to clear
+		err = nil
+	}
+	return err
+}
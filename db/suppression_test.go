@@ -0,0 +1,101 @@
+package db
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSuppressionPolicies(t *T) {
+	ps, err := parseSuppressionPolicies("spam:1/8760h, bounce:2/720h")
+	require.Nil(t, err)
+	assert.Equal(t, []suppressionPolicy{
+		{kind: SuppressionSpam, count: 1, window: 8760 * time.Hour},
+		{kind: SuppressionBounce, count: 2, window: 720 * time.Hour},
+	}, ps)
+
+	ps, err = parseSuppressionPolicies("")
+	require.Nil(t, err)
+	assert.Empty(t, ps)
+
+	ps, err = parseSuppressionPolicies("hardbounce:1/1h,softbounce:3/1h,block:2/1h")
+	require.Nil(t, err)
+	assert.Len(t, ps, 3)
+
+	for _, spec := range []string{"spam", "spam:1", "open:1/1h", "spam:0/1h", "spam:1/0s", "spam:1/x"} {
+		_, err = parseSuppressionPolicies(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestSuppressionReason(t *T) {
+	defer func(ps []suppressionPolicy) { suppressionPolicies = ps }(suppressionPolicies)
+	suppressionPolicies = []suppressionPolicy{
+		{kind: SuppressionSpam, count: 1, window: time.Hour},
+		{kind: SuppressionBounce, count: 2, window: time.Hour},
+	}
+	now := time.Now()
+
+	doc := &EmailDoc{Bounces: []time.Time{now.Add(-2 * time.Hour), now.Add(-time.Minute)}}
+	assert.Equal(t, "", suppressionReason(doc, now))
+
+	doc.Bounces = append(doc.Bounces, now)
+	assert.Equal(t, SuppressionBounce, suppressionReason(doc, now))
+
+	doc.SpamReports = []time.Time{now}
+	assert.Equal(t, SuppressionSpam, suppressionReason(doc, now))
+
+	// the bounce policy counts bounces of every class, but the class
+	// policies only count their own
+	suppressionPolicies = []suppressionPolicy{
+		{kind: SuppressionHardBounce, count: 1, window: time.Hour},
+	}
+	doc = &EmailDoc{
+		Bounces:     []time.Time{now, now},
+		SoftBounces: []time.Time{now},
+		Blocks:      []time.Time{now},
+	}
+	assert.Equal(t, "", suppressionReason(doc, now))
+	doc.HardBounces = []time.Time{now}
+	assert.Equal(t, SuppressionHardBounce, suppressionReason(doc, now))
+
+	// events from before being cleared don't count
+	doc.SuppressionsCleared = now
+	assert.Equal(t, "", suppressionReason(doc, now))
+}
+
+func TestSuppressions(t *T) {
+	require.False(t, mongoDisabled)
+	defer func(ps []suppressionPolicy) { suppressionPolicies = ps }(suppressionPolicies)
+	suppressionPolicies = []suppressionPolicy{
+		{kind: SuppressionBounce, count: 2, window: time.Hour},
+	}
+
+	email := testutil.RandStr() + "@test.com"
+	require.Nil(t, StoreEmailBounce(email, nil, time.Time{}))
+	assert.True(t, VerifyEmailAllowed(email, 1))
+
+	require.Nil(t, StoreEmailBounce(email, nil, time.Time{}))
+	assert.False(t, VerifyEmailAllowed(email, 1))
+
+	ss, err := ListSuppressions(1000)
+	require.Nil(t, err)
+	var found bool
+	for _, s := range ss {
+		if s.Email == email {
+			found = true
+			assert.Equal(t, SuppressionBounce, s.Reason)
+			assert.Len(t, s.Bounces, 2)
+		}
+	}
+	assert.True(t, found)
+
+	require.Nil(t, ClearSuppression(email))
+	assert.True(t, VerifyEmailAllowed(email, 1))
+
+	// clearing an address that was never stored isn't an error
+	assert.Nil(t, ClearSuppression(testutil.RandStr()+"@test.com"))
+}
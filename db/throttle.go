@@ -0,0 +1,185 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// domainLimits holds the limit for each recipient domain which has one
+	domainLimits = map[string]*domainLimit{}
+
+	// warmupStarts holds the day each route started warming up
+	warmupStarts = map[string]time.Time{}
+
+	// warmupStartVolume is how many emails can be sent through a warming up
+	// route on its first day, which grows each day until it reaches
+	// warmupTargetVolume after warmupDays
+	warmupStartVolume  = 50
+	warmupTargetVolume = 100000
+	warmupDays         = 30
+)
+
+// domainLimit spaces out emails to a domain so that no more than the limit are
+// sent each minute. Emails reserve the next free slot, and give it back if they
+// end up not being sent in it
+type domainLimit struct {
+	interval time.Duration
+
+	l    sync.Mutex
+	next time.Time
+}
+
+func newDomainLimit(perMinute int) *domainLimit {
+	return &domainLimit{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// reserve reserves the next slot to send an email and returns how long until
+// that slot. A nil domainLimit always returns 0
+func (d *domainLimit) reserve() time.Duration {
+	if d == nil {
+		return 0
+	}
+	d.l.Lock()
+	defer d.l.Unlock()
+	now := time.Now()
+	if d.next.Before(now) {
+		d.next = now
+	}
+	wait := d.next.Sub(now)
+	d.next = d.next.Add(d.interval)
+	return wait
+}
+
+// release gives back a slot which was reserved but not used, so the next
+// email can have it. A nil domainLimit does nothing
+func (d *domainLimit) release() {
+	if d == nil {
+		return
+	}
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.next = d.next.Add(-d.interval)
+	if now := time.Now(); d.next.Before(now) {
+		d.next = now
+	}
+}
+
+// recipientDomainLimit returns the domainLimit for the recipient's domain, or
+// nil if it doesn't have one
+func recipientDomainLimit(recipient string) *domainLimit {
+	i := strings.LastIndex(recipient, "@")
+	if i < 0 {
+		return nil
+	}
+	return domainLimits[strings.ToLower(recipient[i+1:])]
+}
+
+// domainDelay reserves a slot for an email to the recipient and returns how long
+// until it can be sent
+func domainDelay(recipient string) time.Duration {
+	return recipientDomainLimit(recipient).reserve()
+}
+
+// releaseDomainDelay gives back the slot reserved by domainDelay for an email
+// to the recipient which isn't going to be sent in it
+func releaseDomainDelay(recipient string) {
+	recipientDomainLimit(recipient).release()
+}
+
+// parseDomainRates parses a spec in the form of domain=perMinute,...
+func parseDomainRates(spec string) (map[string]*domainLimit, error) {
+	m := map[string]*domainLimit{}
+	if strings.TrimSpace(spec) == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid domain rate %q", part)
+		}
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid rate for domain %q", part[:i])
+		}
+		m[strings.ToLower(part[:i])] = newDomainLimit(n)
+	}
+	return m, nil
+}
+
+// parseWarmupRoutes parses a spec in the form of route=YYYY-MM-DD,... where the
+// date is the first day of the route's warmup
+func parseWarmupRoutes(spec string) (map[string]time.Time, error) {
+	m := map[string]time.Time{}
+	if strings.TrimSpace(spec) == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.LastIndex(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid warmup route %q", part)
+		}
+		start, err := time.Parse("2006-01-02", part[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid warmup start for route %q", part[:i])
+		}
+		m[part[:i]] = start
+	}
+	return m, nil
+}
+
+// warmupLimit returns how many emails can be sent through a route on the day
+// which is day days after it started warming up. The limit grows exponentially
+// from warmupStartVolume to warmupTargetVolume. -1 is returned once the route
+// is warmed up
+func warmupLimit(day int) int {
+	if day >= warmupDays {
+		return -1
+	}
+	if day < 0 {
+		day = 0
+	}
+	growth := float64(warmupTargetVolume) / float64(warmupStartVolume)
+	return int(float64(warmupStartVolume) * math.Pow(growth, float64(day)/float64(warmupDays)))
+}
+
+// warmupDelay returns how long an email through route needs to wait because of
+// the route's warmup. If the route has already sent its limit for today then
+// the email waits until sometime within the first hour of tomorrow, so that
+// the emails which were held back don't all come back at once
+func warmupDelay(route string) (time.Duration, error) {
+	start, ok := warmupStarts[route]
+	if !ok || mongoDisabled {
+		return 0, nil
+	}
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	limit := warmupLimit(int(today.Sub(start).Hours() / 24))
+	if limit < 0 {
+		return 0, nil
+	}
+
+	var n int
+	var err error
+	statsSH.WithColl(func(c *mgo.Collection) {
+		n, err = c.Find(bson.M{
+			"rt": route,
+			"tc": bson.M{"$gte": toTS(today)},
+		}).Count()
+	})
+	if err != nil || n < limit {
+		return 0, err
+	}
+	tomorrow := today.Add(24 * time.Hour)
+	return tomorrow.Sub(now) + time.Duration(rand.Int63n(int64(time.Hour))), nil
+}
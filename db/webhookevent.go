@@ -0,0 +1,63 @@
+package db
+
+import (
+	"time"
+
+	"github.com/levenlabs/golib/mgoutil"
+	"gopkg.in/mgo.v2"
+)
+
+// webhookEventDoc records that the webhook event with the ID was already
+// applied. It's removed once Expires passes
+type webhookEventDoc struct {
+	ID      string    `bson:"_id"`
+	Expires time.Time `bson:"exp"`
+}
+
+var (
+	webhookEventsSH   mgoutil.SessionHelper
+	webhookEventsColl = "webhookevents"
+
+	// webhookEventTTL is how long the IDs of webhook events are remembered for
+	// and is set by --webhook-event-ttl. It should be longer than the provider
+	// keeps retrying webhooks for
+	webhookEventTTL = 72 * time.Hour
+)
+
+// claimWebhookEvent claims the provider's ID of a webhook event so that it's
+// only applied once. False is returned if it was already claimed, in which
+// case the event is a retry and should be skipped. Since there's nothing to
+// dedupe against when mongo is disabled every event is claimable
+func claimWebhookEvent(id string) (bool, error) {
+	if mongoDisabled {
+		return true, nil
+	}
+	doc := &webhookEventDoc{
+		ID:      id,
+		Expires: time.Now().Add(webhookEventTTL),
+	}
+	var err error
+	webhookEventsSH.WithColl(func(c *mgo.Collection) {
+		err = c.Insert(doc)
+	})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseWebhookEvent removes the claim on the provider's ID of a webhook event
+// so that it can be applied again. It's used when applying the event failed
+func releaseWebhookEvent(id string) error {
+	if mongoDisabled {
+		return nil
+	}
+	var err error
+	webhookEventsSH.WithColl(func(c *mgo.Collection) {
+		err = c.RemoveId(id)
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -23,15 +23,200 @@ var GA = genapi.GenAPI{
 		Optional: true,
 	},
 	LeverParams: []lever.Param{
+		{
+			Name:        "--sender",
+			Description: "Email provider(s) to send through: sendgrid, smtp, mailgun, ses or postmark. A comma separated list is a failover chain, and name:weight splits emails across providers by weight",
+			Default:     "sendgrid",
+		},
+		{
+			Name:        "--sender-breaker-threshold",
+			Description: "Number of consecutive failures before a provider is skipped over",
+			Default:     "5",
+		},
+		{
+			Name:        "--sender-breaker-cooldown",
+			Description: "How long a failing provider is skipped over before being tried again",
+			Default:     "30s",
+		},
 		{
 			Name:        "--sendgrid-key",
-			Description: "Sendgrid API Key",
+			Description: "Sendgrid API Key. Required when sending through sendgrid",
 		},
 		{
 			Name:        "--sendgrid-ip-pool",
-			Description: "Specify a SendGrid IP pool for all emails to come from",
+			Description: "Specify a SendGrid IP pool for all emails to come from, unless overridden by --routes",
+			Default:     "",
+		},
+		{
+			Name:        "--send-max-attempts",
+			Description: "Number of times to try sending an email before giving up on it",
+			Default:     "8",
+		},
+		{
+			Name:        "--send-retry-backoff",
+			Description: "How long to wait before retrying a failed email. This doubles after each attempt",
+			Default:     "30s",
+		},
+		{
+			Name:        "--send-retry-max-backoff",
+			Description: "Longest to wait before retrying a failed email",
+			Default:     "1h",
+		},
+		{
+			Name:        "--routes",
+			Description: "Comma separated list of flags=provider[:pool[:key]] routes. Emails are sent through the first route sharing any of its flags, otherwise through --sender",
+			Default:     "",
+		},
+		{
+			Name:        "--routes-failover",
+			Description: "Comma separated list of routes, by their provider:pool name, which fail over to --sender when their provider fails. Those providers send with their own pool and key",
+			Default:     "",
+		},
+		{
+			Name:        "--webhook-event-ttl",
+			Description: "How long the IDs of webhook events are remembered for so that retried events are only applied once",
+			Default:     "72h",
+		},
+		{
+			Name:        "--idempotency-ttl",
+			Description: "How long the idempotencyKey of an Enqueue is remembered for",
+			Default:     "24h",
+		},
+		{
+			Name:        "--frequency-caps",
+			Description: "Comma separated list of flags:max/window caps, such as 4:3/168h, for the max number of emails sharing any of the flags a recipient can be sent within the window. Requires mongo",
 			Default:     "",
 		},
+		{
+			Name:        "--suppression-policies",
+			Description: "Comma separated list of kind:count/window policies, such as spam:1/8760h,bounce:2/720h, which stop emails from being sent to an address once it has count bounces or spam reports within the window",
+			Default:     "",
+		},
+		{
+			Name:        "--queue-workers",
+			Description: "Comma separated list of queue=workers for how many emails are sent from each queue at once. Queues not listed get 1 worker",
+			Default:     "",
+		},
+		{
+			Name:        "--send-rate",
+			Description: "Max number of emails sent per second across all providers. 0 is unlimited",
+			Default:     "0",
+		},
+		{
+			Name:        "--provider-rates",
+			Description: "Comma separated list of provider=rate for the max number of emails sent per second through each provider",
+			Default:     "",
+		},
+		{
+			Name:        "--send-rate-max-wait",
+			Description: "Longest an email waits for a rate limit before being put back in its queue",
+			Default:     "5s",
+		},
+		{
+			Name:        "--domain-rates",
+			Description: "Comma separated list of domain=rate for the max number of emails sent to each recipient domain per minute, per instance",
+			Default:     "",
+		},
+		{
+			Name:        "--warmup-routes",
+			Description: "Comma separated list of route=YYYY-MM-DD for routes whose IP pool is being warmed up and the day it started. Requires mongo",
+			Default:     "",
+		},
+		{
+			Name:        "--warmup-start-volume",
+			Description: "Max number of emails sent through a warming up route on its first day",
+			Default:     "50",
+		},
+		{
+			Name:        "--warmup-target-volume",
+			Description: "Number of emails a day a warming up route grows to by the end of its warmup",
+			Default:     "100000",
+		},
+		{
+			Name:        "--warmup-days",
+			Description: "Number of days a warmup lasts",
+			Default:     "30",
+		},
+		{
+			Name:        "--priority-high-flags",
+			Description: "Emails sharing any of these flags are sent with high priority unless they have a priority",
+			Default:     "0",
+		},
+		{
+			Name:        "--priority-low-flags",
+			Description: "Emails sharing any of these flags are sent with low priority unless they have a priority",
+			Default:     "0",
+		},
+		{
+			Name:        "--smtp-addr",
+			Description: "Address (host:port) of the SMTP relay. Required when sending through smtp",
+			Default:     "",
+		},
+		{
+			Name:        "--smtp-user",
+			Description: "Username to authenticate with the SMTP relay. No authentication is done if empty",
+			Default:     "",
+		},
+		{
+			Name:        "--smtp-pass",
+			Description: "Password to authenticate with the SMTP relay",
+			Default:     "",
+		},
+		{
+			Name:        "--smtp-auth",
+			Description: "SASL mechanism used to authenticate with the SMTP relay. One of: plain, login",
+			Default:     "plain",
+		},
+		{
+			Name:        "--smtp-skip-starttls",
+			Description: "Allow sending over unencrypted connections if the SMTP relay doesn't support STARTTLS. Only use this for local relays",
+			Flag:        true,
+		},
+		{
+			Name:        "--mailgun-key",
+			Description: "Mailgun API Key. Required when sending through mailgun",
+			Default:     "",
+		},
+		{
+			Name:        "--mailgun-domain",
+			Description: "Mailgun sending domain. Required when sending through mailgun",
+			Default:     "",
+		},
+		{
+			Name:        "--mailgun-url",
+			Description: "Mailgun API URL. Use https://api.eu.mailgun.net for domains in the EU region",
+			Default:     "https://api.mailgun.net",
+		},
+		{
+			Name:        "--ses-region",
+			Description: "AWS region to use SES in. Required when sending through ses",
+			Default:     "",
+		},
+		{
+			Name:        "--ses-access-key",
+			Description: "AWS access key ID for SES. Required when sending through ses",
+			Default:     "",
+		},
+		{
+			Name:        "--ses-secret-key",
+			Description: "AWS secret access key for SES. Required when sending through ses",
+			Default:     "",
+		},
+		{
+			Name:        "--ses-configuration-set",
+			Description: "SES configuration set to send all emails with",
+			Default:     "",
+		},
+		{
+			Name:        "--postmark-token",
+			Description: "Postmark server API token. Required when sending through postmark",
+			Default:     "",
+		},
+		{
+			Name:        "--postmark-stream",
+			Description: "Postmark message stream to send all emails through",
+			Default:     "outbound",
+		},
 		{
 			Name:        "--webhook-addr",
 			Description: "Address to listen for webhooks from sendgrid on",
@@ -42,6 +227,16 @@ var GA = genapi.GenAPI{
 			Description: "Password (basic auth) to require for the webhook",
 			Default:     "",
 		},
+		{
+			Name:        "--webhook-verification-key",
+			Description: "SendGrid's signed event webhook verification key. If set, every webhook request must be signed with it",
+			Default:     "",
+		},
+		{
+			Name:        "--webhook-timestamp-tolerance",
+			Description: "How far the timestamp of a signed webhook request can be from now before it's rejected",
+			Default:     "5m",
+		},
 		{
 			Name:        "--environment",
 			Description: "Running environment. Only prod and staging webhooks are processed.",
@@ -0,0 +1,187 @@
+package rpc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/rpcutil"
+	"github.com/levenlabs/postmaster/sender"
+	"gopkg.in/validator.v2"
+)
+
+// The statuses of each recipient in EnqueueBatch
+const (
+	BatchQueued     = "queued"
+	BatchSuppressed = "suppressed"
+	BatchSkipped    = "skipped"
+	BatchInvalid    = "invalid"
+	BatchError      = "error"
+)
+
+// BatchRecipient is a single recipient of an EnqueueBatch
+type BatchRecipient struct {
+	To     string `json:"to"`
+	ToName string `json:"toName,omitempty"`
+
+	// Substitutions replace each occurrence of a key in the template's
+	// subject, html and text with its value
+	Substitutions map[string]string `json:"substitutions,omitempty"`
+
+	// UniqueArgs are added to the template's uniqueArgs
+	UniqueArgs map[string]string `json:"uniqueArgs,omitempty"`
+
+	// UniqueID overrides the template's uniqueID
+	UniqueID string `json:"uniqueID,omitempty"`
+}
+
+// EnqueueBatchArgs defines the arguments of EnqueueBatch
+type EnqueueBatchArgs struct {
+	// Template is the email sent to every recipient. Its to and toName are
+	// ignored. It's validated for each recipient after the recipient is
+	// applied to it
+	Template sender.Mail `json:"template" validate:"-"`
+
+	Recipients []BatchRecipient `json:"recipients" validate:"min=1,max=1000"`
+}
+
+// BatchItemResult is the result of a single recipient of an EnqueueBatch
+type BatchItemResult struct {
+	To string `json:"to"`
+
+	// Status is one of queued, suppressed, skipped, invalid or error
+	Status string `json:"status"`
+
+	// Error is why the email was invalid or couldn't be queued
+	Error string `json:"error,omitempty"`
+
+	// StatsID is the ID of the email's stats, it's only set when the email
+	// was queued and mongo is being used
+	StatsID string `json:"statsID,omitempty"`
+
+	// JobID is only set when the email was scheduled with sendAt
+	JobID string `json:"jobID,omitempty"`
+}
+
+// EnqueueBatchResult holds the result of EnqueueBatch, with a result for each
+// recipient in the same order they were sent in
+type EnqueueBatchResult struct {
+	Results []BatchItemResult `json:"results"`
+}
+
+// EnqueueBatch queues the same email to many recipients at once. Each
+// recipient is handled as if it was sent to Enqueue on its own, and a failure
+// for one doesn't stop the rest from being queued
+func (Postmaster) EnqueueBatch(r *http.Request, args *EnqueueBatchArgs, reply *EnqueueBatchResult) error {
+	kv := rpcutil.RequestKV(r)
+	kv["recipients"] = len(args.Recipients)
+	kv["flags"] = args.Template.Flags
+	kv["subject"] = args.Template.Subject
+
+	counts := map[string]int{}
+	reply.Results = make([]BatchItemResult, len(args.Recipients))
+	for i, rcpt := range args.Recipients {
+		res := enqueueBatchItem(&args.Template, &rcpt)
+		counts[res.Status]++
+		reply.Results[i] = res
+	}
+	for status, n := range counts {
+		kv[status] = n
+	}
+	llog.Info("enqueued batch", kv)
+	return nil
+}
+
+func enqueueBatchItem(tpl *sender.Mail, rcpt *BatchRecipient) BatchItemResult {
+	res := BatchItemResult{To: rcpt.To}
+	m := batchMail(tpl, rcpt)
+	err := validator.Validate(m)
+	if err == nil {
+		err = validateEnqueueArgs(m)
+	}
+	if err != nil {
+		res.Status = BatchInvalid
+		res.Error = err.Error()
+		return res
+	}
+
+	kv := llog.KV{"to": m.To, "flags": m.Flags, "subject": m.Subject}
+	eres, err := enqueue(m, kv)
+	if err != nil {
+		llog.Error("error queueing batch email", kv, llog.ErrKV(err))
+		res.Status = BatchError
+		res.Error = err.Error()
+		return res
+	} else if eres.Suppressed {
+		res.Status = BatchSuppressed
+		return res
+	} else if eres.Skipped {
+		res.Status = BatchSkipped
+		return res
+	}
+	res.Status = BatchQueued
+	res.StatsID = eres.StatsID
+	res.JobID = eres.JobID
+	return res
+}
+
+// maxIdempotencyKey is the longest IdempotencyKey sender.Mail allows
+const maxIdempotencyKey = 256
+
+// batchMail returns a copy of the template addressed to the recipient, with the
+// recipient's substitutions applied
+func batchMail(tpl *sender.Mail, rcpt *BatchRecipient) *sender.Mail {
+	m := *tpl
+	m.To = rcpt.To
+	m.ToName = rcpt.ToName
+	if rcpt.UniqueID != "" {
+		m.UniqueID = rcpt.UniqueID
+	}
+	if tpl.IdempotencyKey != "" {
+		// each recipient needs their own key so they aren't seen as retries
+		// of each other
+		m.IdempotencyKey = tpl.IdempotencyKey + ":" + rcpt.To
+		if len(m.IdempotencyKey) > maxIdempotencyKey {
+			// hash it so it still passes Enqueue's validation
+			sum := sha256.Sum256([]byte(m.IdempotencyKey))
+			m.IdempotencyKey = hex.EncodeToString(sum[:])
+		}
+	}
+
+	if len(tpl.UniqueArgs) > 0 || len(rcpt.UniqueArgs) > 0 {
+		m.UniqueArgs = make(map[string]string, len(tpl.UniqueArgs)+len(rcpt.UniqueArgs))
+		for k, v := range tpl.UniqueArgs {
+			m.UniqueArgs[k] = v
+		}
+		for k, v := range rcpt.UniqueArgs {
+			m.UniqueArgs[k] = v
+		}
+	}
+
+	if len(rcpt.Substitutions) > 0 {
+		// when keys overlap the replacer picks whichever comes first, so put
+		// longer keys first to make it the most specific one every time
+		ks := make([]string, 0, len(rcpt.Substitutions))
+		for k := range rcpt.Substitutions {
+			ks = append(ks, k)
+		}
+		sort.Slice(ks, func(i, j int) bool {
+			if len(ks[i]) != len(ks[j]) {
+				return len(ks[i]) > len(ks[j])
+			}
+			return ks[i] < ks[j]
+		})
+		pairs := make([]string, 0, len(ks)*2)
+		for _, k := range ks {
+			pairs = append(pairs, k, rcpt.Substitutions[k])
+		}
+		rep := strings.NewReplacer(pairs...)
+		m.Subject = rep.Replace(m.Subject)
+		m.HTML = rep.Replace(m.HTML)
+		m.Text = rep.Replace(m.Text)
+	}
+	return &m
+}
@@ -0,0 +1,84 @@
+package rpc
+
+import (
+	"strings"
+	. "testing"
+
+	"github.com/levenlabs/postmaster/sender"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchMail(t *T) {
+	tpl := &sender.Mail{
+		From:       "from@test.com",
+		Subject:    "Hi -name-",
+		HTML:       "<b>-name-</b> -code-",
+		Text:       "-name- -code-",
+		UniqueArgs: map[string]string{"campaign": "1", "a": "b"},
+		UniqueID:   "newsletter",
+	}
+	rcpt := &BatchRecipient{
+		To:            "to@test.com",
+		ToName:        "To",
+		Substitutions: map[string]string{"-name-": "Bob", "-code-": "123"},
+		UniqueArgs:    map[string]string{"a": "c"},
+	}
+	m := batchMail(tpl, rcpt)
+	assert.Equal(t, "to@test.com", m.To)
+	assert.Equal(t, "To", m.ToName)
+	assert.Equal(t, "Hi Bob", m.Subject)
+	assert.Equal(t, "<b>Bob</b> 123", m.HTML)
+	assert.Equal(t, "Bob 123", m.Text)
+	assert.Equal(t, map[string]string{"campaign": "1", "a": "c"}, m.UniqueArgs)
+	assert.Equal(t, "newsletter", m.UniqueID)
+
+	// the template shouldn't be changed
+	assert.Equal(t, "Hi -name-", tpl.Subject)
+	assert.Equal(t, "b", tpl.UniqueArgs["a"])
+	assert.Equal(t, "", tpl.To)
+
+	rcpt.UniqueID = "other"
+	assert.Equal(t, "other", batchMail(tpl, rcpt).UniqueID)
+
+	assert.Empty(t, m.IdempotencyKey)
+	tpl.IdempotencyKey = "key"
+	assert.Equal(t, "key:to@test.com", batchMail(tpl, rcpt).IdempotencyKey)
+
+	// keys which would be too long are hashed
+	tpl.IdempotencyKey = strings.Repeat("k", 256)
+	k := batchMail(tpl, rcpt).IdempotencyKey
+	assert.Len(t, k, 64)
+	assert.Equal(t, k, batchMail(tpl, rcpt).IdempotencyKey)
+	rcpt.To = "other@test.com"
+	assert.NotEqual(t, k, batchMail(tpl, rcpt).IdempotencyKey)
+}
+
+func TestBatchMailOverlappingSubstitutions(t *T) {
+	tpl := &sender.Mail{Text: "-name- -name-full-"}
+	rcpt := &BatchRecipient{
+		To: "to@test.com",
+		Substitutions: map[string]string{
+			"-name-":      "Bob",
+			"-name-full-": "Bob Smith",
+			"-name-f":     "X",
+		},
+	}
+	// the longest key always wins no matter the map's order
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, "Bob Bob Smith", batchMail(tpl, rcpt).Text)
+	}
+}
+
+func TestEnqueueBatchItemInvalid(t *T) {
+	tpl := &sender.Mail{
+		From:    "from@test.com",
+		Subject: "Hi",
+		Text:    "hey",
+	}
+	res := enqueueBatchItem(tpl, &BatchRecipient{To: "notanemail"})
+	assert.Equal(t, BatchInvalid, res.Status)
+	assert.NotEmpty(t, res.Error)
+
+	res = enqueueBatchItem(tpl, &BatchRecipient{To: "test@test"})
+	assert.Equal(t, BatchInvalid, res.Status)
+}
@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/rpcutil"
+	"github.com/levenlabs/golib/timeutil"
+	"github.com/levenlabs/postmaster/db"
+)
+
+// ListDeadLettersArgs defines the arguments of ListDeadLetters
+type ListDeadLettersArgs struct {
+	// To is optional and only returns dead letters for that recipient
+	To string `json:"to,omitempty" validate:"max=256"`
+
+	// Limit is the max number of dead letters to return, defaulting to 100
+	Limit int `json:"limit,omitempty" validate:"min=0,max=1000"`
+}
+
+// DeadLetterResult is a db.DeadLetter along with the job that failed
+type DeadLetterResult struct {
+	db.DeadLetter
+	Job json.RawMessage `json:"job"`
+}
+
+// ListDeadLettersResult holds the result of ListDeadLetters
+type ListDeadLettersResult struct {
+	DeadLetters []DeadLetterResult `json:"deadLetters"`
+}
+
+// ListDeadLetters returns the newest emails that were given up on
+func (Postmaster) ListDeadLetters(r *http.Request, args *ListDeadLettersArgs, reply *ListDeadLettersResult) error {
+	limit := args.Limit
+	if limit == 0 {
+		limit = 100
+	}
+	docs, err := db.ListDeadLetters(args.To, limit)
+	if err != nil {
+		return err
+	}
+	reply.DeadLetters = make([]DeadLetterResult, len(docs))
+	for i, d := range docs {
+		reply.DeadLetters[i] = DeadLetterResult{
+			DeadLetter: d,
+			Job:        json.RawMessage(d.Contents),
+		}
+	}
+	return nil
+}
+
+// DeadLetterArgs defines the arguments of ReplayDeadLetter
+type DeadLetterArgs struct {
+	ID string `json:"id" validate:"nonzero"`
+}
+
+// ReplayDeadLetter puts a dead letter back in the send queue
+func (Postmaster) ReplayDeadLetter(r *http.Request, args *DeadLetterArgs, reply *SuccessResult) error {
+	kv := rpcutil.RequestKV(r)
+	kv["id"] = args.ID
+	if err := db.ReplayDeadLetter(args.ID); err != nil {
+		return err
+	}
+	llog.Info("replayed dead letter", kv)
+	reply.Success = true
+	return nil
+}
+
+// PurgeDeadLettersArgs defines the arguments of PurgeDeadLetters
+type PurgeDeadLettersArgs struct {
+	// Before is optional and only purges dead letters created before then,
+	// otherwise all of them are purged
+	Before timeutil.Timestamp `json:"before"`
+}
+
+// PurgeDeadLettersResult holds the result of PurgeDeadLetters
+type PurgeDeadLettersResult struct {
+	Purged int `json:"purged"`
+}
+
+// PurgeDeadLetters removes dead letters without replaying them
+func (Postmaster) PurgeDeadLetters(r *http.Request, args *PurgeDeadLettersArgs, reply *PurgeDeadLettersResult) error {
+	before := args.Before.Time
+	if before.IsZero() {
+		before = time.Now()
+	}
+	n, err := db.PurgeDeadLetters(before)
+	if err != nil {
+		return err
+	}
+	kv := rpcutil.RequestKV(r)
+	kv["purged"] = n
+	llog.Info("purged dead letters", kv)
+	reply.Purged = n
+	return nil
+}
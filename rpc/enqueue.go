@@ -7,16 +7,43 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/golib/rpcutil"
+	"github.com/levenlabs/golib/timeutil"
 	"github.com/levenlabs/postmaster/db"
 	"github.com/levenlabs/postmaster/sender"
 )
 
+// EnqueueResult holds the result of Enqueue
+type EnqueueResult struct {
+	Success bool `json:"success"`
+
+	// StatsID is the ID of the email's stats, which is sent along with the
+	// email to the provider. It's empty if the email was suppressed or mongo
+	// isn't being used
+	StatsID string `json:"statsID,omitempty"`
+
+	// Suppressed is true if the email wasn't queued because the recipient's
+	// prefs block its flags
+	Suppressed bool `json:"suppressed"`
+
+	// Skipped is true if the email wasn't queued because an email with the
+	// same uniqueID was sent to the recipient within minInterval, or because
+	// the recipient has been sent too many emails with its flags. SkipReason
+	// is either minInterval or frequencyCap
+	Skipped    bool   `json:"skipped"`
+	SkipReason string `json:"skipReason,omitempty"`
+
+	// JobID is only set when the email was scheduled with sendAt and can be
+	// passed to CancelScheduled
+	JobID string `json:"jobID,omitempty"`
+}
+
 // Enqueue queues an email to be sent to sendgrid it accepts an instance of
 // sender.Mail
-func (Postmaster) Enqueue(r *http.Request, args *sender.Mail, reply *SuccessResult) error {
+func (Postmaster) Enqueue(r *http.Request, args *sender.Mail, reply *EnqueueResult) error {
 	kv := rpcutil.RequestKV(r)
 	kv["to"] = args.To
 	kv["flags"] = args.Flags
@@ -29,30 +56,175 @@ func (Postmaster) Enqueue(r *http.Request, args *sender.Mail, reply *SuccessResu
 		return err
 	}
 
+	res, err := enqueue(args, kv)
+	if err != nil {
+		return err
+	}
+	*reply = *res
+	return nil
+}
+
+// enqueue queues the already validated email unless the recipient's prefs block
+// it. If the email has an IdempotencyKey which was already used then the
+// result from then is returned instead
+func enqueue(args *sender.Mail, kv llog.KV) (*EnqueueResult, error) {
+	key := args.IdempotencyKey
+	if key != "" {
+		kv["idempotencyKey"] = key
+		prev, err := db.ClaimIdempotencyKey(key)
+		if err != nil {
+			return nil, err
+		} else if prev != nil {
+			llog.Info("already enqueued email with idempotencyKey", kv)
+			return &EnqueueResult{
+				Success:    true,
+				StatsID:    prev.StatsID,
+				Suppressed: prev.Suppressed,
+				Skipped:    prev.Skipped,
+				SkipReason: prev.SkipReason,
+				JobID:      prev.JobID,
+			}, nil
+		}
+	}
+
+	res, err := enqueueAllowed(args, kv)
+	if err != nil {
+		if key != "" {
+			// let the caller retry it
+			if rerr := db.ReleaseIdempotencyKey(key); rerr != nil {
+				llog.Error("error releasing idempotencyKey", kv, llog.ErrKV(rerr))
+			}
+		}
+		return nil, err
+	}
+
+	if key != "" {
+		err := db.StoreIdempotentResult(key, &db.IdempotentResult{
+			StatsID:    res.StatsID,
+			JobID:      res.JobID,
+			Suppressed: res.Suppressed,
+			Skipped:    res.Skipped,
+			SkipReason: res.SkipReason,
+		})
+		if err != nil {
+			// the email was already queued so we don't want to return an
+			// error, which would cause the caller to retry
+			llog.Error("error storing idempotent result", kv, llog.ErrKV(err))
+		}
+	}
+	return res, nil
+}
+
+// enqueueAllowed queues the email unless the recipient's prefs block it or an
+// email with the same uniqueID was sent within its MinInterval
+func enqueueAllowed(args *sender.Mail, kv llog.KV) (*EnqueueResult, error) {
+	res := &EnqueueResult{Success: true}
 	allowed := db.VerifyEmailAllowed(args.To, args.Flags)
 	if !allowed {
 		kv["flags"] = fmt.Sprintf("%b", args.Flags)
 		llog.Warn("cannot send email due to flags", kv)
 		//even though we didn't send it, it didn't fail, the user just doesn't want this email
-		reply.Success = true
-		return nil
+		res.Suppressed = true
+		return res, nil
+	}
+
+	over, err := db.OverFrequencyCap(args.To, args.Flags)
+	if err != nil {
+		return nil, err
+	} else if over {
+		db.AssignStatsID(args)
+		res.StatsID = db.SuppressEmail(args, db.SuppressedFrequencyCap)
+		kv["statsID"] = res.StatsID
+		llog.Info("skipping email over frequency cap", kv)
+		res.Skipped = true
+		res.SkipReason = "frequencyCap"
+		return res, nil
 	}
 
+	if args.MinInterval > 0 {
+		interval := time.Duration(args.MinInterval) * time.Second
+		ok, err := db.ClaimUniqueID(args.To, args.UniqueID, interval)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			kv["uniqueID"] = args.UniqueID
+			llog.Info("skipping email sent within minInterval", kv)
+			res.Skipped = true
+			res.SkipReason = "minInterval"
+			return res, nil
+		}
+	}
+
+	if res.StatsID, res.JobID, err = queueMail(args, kv); err != nil {
+		if args.MinInterval > 0 {
+			if rerr := db.ReleaseUniqueID(args.To, args.UniqueID); rerr != nil {
+				llog.Error("error releasing uniqueID", kv, llog.ErrKV(rerr))
+			}
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// queueMail assigns the email its stats ID and stores it in its send queue, or
+// holds onto it if it's scheduled for later in which case the ID of the
+// scheduled job is also returned
+func queueMail(args *sender.Mail, kv llog.KV) (string, string, error) {
+	statsID := db.AssignStatsID(args)
+	kv["statsID"] = statsID
+	setExpiry(args)
 	contents, err := json.Marshal(args)
 	if err != nil {
-		return err
+		return "", "", err
+	}
+
+	priority := sender.PickPriority(args)
+	kv["priority"] = priority
+
+	if args.SendAt != nil && args.SendAt.After(time.Now()) {
+		kv["sendAt"] = args.SendAt
+		llog.Info("storing new scheduled email job", kv)
+		jobID, err := db.StoreScheduledSendJob(string(contents), priority, args.SendAt.Time)
+		return statsID, jobID, err
 	}
 
 	llog.Info("storing new email job", kv)
+	return statsID, "", db.StoreSendJob(string(contents), priority)
+}
 
-	err = db.StoreSendJob(string(contents))
-	if err != nil {
+// CancelScheduledArgs defines the arguments of CancelScheduled
+type CancelScheduledArgs struct {
+	JobID string `json:"jobID" validate:"nonzero"`
+}
+
+// CancelScheduled cancels an email that was scheduled with sendAt, as long as
+// it hasn't been sent yet
+func (Postmaster) CancelScheduled(r *http.Request, args *CancelScheduledArgs, reply *SuccessResult) error {
+	kv := rpcutil.RequestKV(r)
+	kv["jobID"] = args.JobID
+	if err := db.CancelScheduledSendJob(args.JobID); err != nil {
+		kv["err"] = err
+		llog.Warn("error cancelling scheduled email", kv)
 		return err
 	}
+	llog.Info("cancelled scheduled email", kv)
 	reply.Success = true
 	return nil
 }
 
+// setExpiry converts the email's TTL into its ExpiresAt
+func setExpiry(args *sender.Mail) {
+	if args.TTL <= 0 {
+		return
+	}
+	from := time.Now()
+	if args.SendAt != nil && args.SendAt.After(from) {
+		from = args.SendAt.Time
+	}
+	args.ExpiresAt = &timeutil.Timestamp{Time: from.Add(time.Duration(args.TTL) * time.Second)}
+	args.TTL = 0
+}
+
 func validateEnqueueArgs(args *sender.Mail) error {
 	if strings.HasSuffix(args.To, "@test") {
 		return errors.New("to address cannot end in @test.com")
@@ -60,5 +232,14 @@ func validateEnqueueArgs(args *sender.Mail) error {
 	if args.HTML == "" && args.Text == "" {
 		return errors.New("you must send either html or text")
 	}
+	if args.MinInterval > 0 && args.UniqueID == "" {
+		return errors.New("uniqueID is required with minInterval")
+	}
+	if args.TTL > 0 && args.ExpiresAt != nil {
+		return errors.New("only one of ttl and expiresAt can be sent")
+	}
+	if !sender.ValidPriority(args.Priority) {
+		return errors.New("priority must be high, normal or low")
+	}
 	return nil
 }
@@ -1,9 +1,13 @@
 package rpc
 
 import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/timeutil"
 	"github.com/levenlabs/postmaster/sender"
 	"github.com/stretchr/testify/assert"
-	. "testing"
+	"github.com/stretchr/testify/require"
 )
 
 func TestValidation(t *T) {
@@ -27,3 +31,53 @@ func TestValidation(t *T) {
 	}
 	assert.Nil(t, validateEnqueueArgs(a))
 }
+
+func TestValidateMinInterval(t *T) {
+	a := &sender.Mail{
+		To:          "test@gmail.com",
+		Text:        "hey",
+		MinInterval: 60,
+	}
+	assert.NotNil(t, validateEnqueueArgs(a))
+
+	a.UniqueID = "welcome"
+	assert.Nil(t, validateEnqueueArgs(a))
+}
+
+func TestValidatePriority(t *T) {
+	a := &sender.Mail{
+		To:       "test@gmail.com",
+		Text:     "hey",
+		Priority: sender.PriorityHigh,
+	}
+	assert.Nil(t, validateEnqueueArgs(a))
+
+	a.Priority = "urgent"
+	assert.NotNil(t, validateEnqueueArgs(a))
+}
+
+func TestSetExpiry(t *T) {
+	a := &sender.Mail{TTL: 60}
+	setExpiry(a)
+	require.NotNil(t, a.ExpiresAt)
+	assert.Equal(t, int64(0), a.TTL)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), a.ExpiresAt.Time, time.Second)
+
+	// scheduled emails expire after they're scheduled for
+	sendAt := time.Now().Add(time.Hour)
+	a = &sender.Mail{TTL: 60, SendAt: &timeutil.Timestamp{Time: sendAt}}
+	setExpiry(a)
+	assert.WithinDuration(t, sendAt.Add(time.Minute), a.ExpiresAt.Time, time.Second)
+
+	a = &sender.Mail{}
+	setExpiry(a)
+	assert.Nil(t, a.ExpiresAt)
+
+	a = &sender.Mail{
+		To:        "test@gmail.com",
+		Text:      "hey",
+		TTL:       60,
+		ExpiresAt: &timeutil.Timestamp{Time: sendAt},
+	}
+	assert.NotNil(t, validateEnqueueArgs(a))
+}
@@ -1,9 +1,12 @@
 package rpc
 
 import (
+	"net/http"
+	"time"
+
+	"github.com/levenlabs/golib/timeutil"
 	"github.com/levenlabs/postmaster/db"
 	"gopkg.in/mgo.v2"
-	"net/http"
 )
 
 type GetLastEmailArgs struct {
@@ -27,3 +30,68 @@ func (Postmaster) GetLastEmail(r *http.Request, args *GetLastEmailArgs, reply *G
 	}
 	return err
 }
+
+type GetEmailStatsArgs struct {
+	StatsID string `json:"statsID" validate:"nonzero"`
+}
+
+// GetEmailStats gets the stats for the email with the statsID returned from
+// Enqueue. If the email hasn't been sent yet, {"stat": null} is returned
+func (Postmaster) GetEmailStats(r *http.Request, args *GetEmailStatsArgs, reply *GetLastEmailResult) error {
+	doc, err := db.GetStats(args.StatsID)
+	reply.Stat = doc
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+type GetEmailEventsResult struct {
+	Events []db.StatEvent `json:"events"`
+}
+
+// GetEmailEvents gets the webhook events for the email with the statsID
+// returned from Enqueue, in the order the provider said they happened. If the
+// email hasn't been sent yet, {"events": []} is returned
+func (Postmaster) GetEmailEvents(r *http.Request, args *GetEmailStatsArgs, reply *GetEmailEventsResult) error {
+	events, err := db.GetStatEvents(args.StatsID)
+	if err == mgo.ErrNotFound {
+		reply.Events = []db.StatEvent{}
+		return nil
+	}
+	reply.Events = events
+	return err
+}
+
+type GetStatCountsArgs struct {
+	// Since is optional and only counts emails created since then, it defaults
+	// to a day before Until so that the whole collection isn't counted
+	Since timeutil.Timestamp `json:"since"`
+
+	// Until is optional and only counts emails created before then, it
+	// defaults to now
+	Until timeutil.Timestamp `json:"until"`
+}
+
+type GetStatCountsResult struct {
+	Counts map[string]int `json:"counts"`
+}
+
+// GetStatCounts gets how many emails created within a time range are in each
+// state
+func (Postmaster) GetStatCounts(r *http.Request, args *GetStatCountsArgs, reply *GetStatCountsResult) error {
+	until := args.Until.Time
+	if until.IsZero() {
+		until = time.Now()
+	}
+	since := args.Since.Time
+	if since.IsZero() {
+		since = until.Add(-24 * time.Hour)
+	}
+	counts, err := db.CountStates(since, until)
+	if err != nil {
+		return err
+	}
+	reply.Counts = counts
+	return nil
+}
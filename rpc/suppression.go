@@ -0,0 +1,48 @@
+package rpc
+
+import (
+	"net/http"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/rpcutil"
+	"github.com/levenlabs/postmaster/db"
+)
+
+// ListSuppressionsArgs defines the arguments of ListSuppressions
+type ListSuppressionsArgs struct {
+	// Limit is the max number of suppressions to return, defaulting to 100
+	Limit int `json:"limit,omitempty" validate:"min=0,max=1000"`
+}
+
+// ListSuppressionsResult holds the result of ListSuppressions
+type ListSuppressionsResult struct {
+	Suppressions []db.Suppression `json:"suppressions"`
+}
+
+// ListSuppressions returns the most recently updated addresses which aren't
+// being sent to because of their bounces or spam reports
+func (Postmaster) ListSuppressions(r *http.Request, args *ListSuppressionsArgs, reply *ListSuppressionsResult) error {
+	limit := args.Limit
+	if limit == 0 {
+		limit = 100
+	}
+	ss, err := db.ListSuppressions(limit)
+	if err != nil {
+		return err
+	}
+	reply.Suppressions = ss
+	return nil
+}
+
+// ClearSuppression allows an address which was suppressed because of its
+// bounces or spam reports to be sent to again
+func (Postmaster) ClearSuppression(r *http.Request, args *EmailArgs, reply *SuccessResult) error {
+	kv := rpcutil.RequestKV(r)
+	kv["email"] = args.Email
+	if err := db.ClearSuppression(args.Email); err != nil {
+		return err
+	}
+	llog.Info("cleared suppression", kv)
+	reply.Success = true
+	return nil
+}
@@ -0,0 +1,53 @@
+package sender
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Error is returned by a Sender when the provider refused to accept an email.
+// Any other error returned from Send, such as a network error, should be
+// considered temporary
+type Error struct {
+	// Provider is the name of the provider that returned the error
+	Provider string
+
+	// StatusCode is the status code returned by the provider
+	StatusCode int
+
+	// Message is the error message returned by the provider
+	Message string
+
+	// Permanent is true if retrying the email would fail the same way, such as
+	// when the payload is malformed or the recipient's address is invalid
+	Permanent bool
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.Provider, e.StatusCode, e.Message)
+}
+
+// IsPermanent returns true if err is an *Error that is permanent
+func IsPermanent(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Permanent
+}
+
+// newHTTPError returns an *Error for the HTTP status code returned by an API.
+// Authentication errors are not permanent since they're caused by our config,
+// not by the email, and will succeed once the config is fixed
+func newHTTPError(provider string, code int, msg string) *Error {
+	var perm bool
+	switch {
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+	case code >= 400 && code < 500:
+		perm = true
+	}
+	return &Error{
+		Provider:   provider,
+		StatusCode: code,
+		Message:    msg,
+		Permanent:  perm,
+	}
+}
@@ -0,0 +1,40 @@
+package sender
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// httpClient is used by the HTTP API providers unless they're given their own
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// doHTTP performs the request using c, or httpClient if c is nil, and returns
+// the response along with its already read body. If the response isn't a 2xx
+// then an *Error is also returned
+func doHTTP(provider string, c *http.Client, r *http.Request) (*http.Response, []byte, error) {
+	if c == nil {
+		c = httpClient
+	}
+	resp, err := c.Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, body, newHTTPError(provider, resp.StatusCode, string(body))
+	}
+	return resp, body, nil
+}
+
+// flagsTag returns the tag used to categorize an email by its flags with
+// providers that support tagging
+func flagsTag(flags int64) string {
+	return "flags-" + strconv.FormatInt(flags, 10)
+}
@@ -0,0 +1,82 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/levenlabs/golib/genapi"
+)
+
+// mailgunURL is the default host for Mailgun API requests. Domains in the EU
+// region must use https://api.eu.mailgun.net instead
+const mailgunURL = "https://api.mailgun.net"
+
+// Mailgun is a Sender which sends emails using the Mailgun messages API
+type Mailgun struct {
+	// Key is the Mailgun API key
+	Key string
+
+	// Domain is the sending domain configured in Mailgun
+	Domain string
+
+	// URL defaults to the Mailgun API and can be changed for the EU region or
+	// for testing
+	URL string
+
+	// Client defaults to httpClient
+	Client *http.Client
+}
+
+func newMailgun(g *genapi.GenAPI) (Sender, error) {
+	m := &Mailgun{}
+	m.Key, _ = g.ParamStr("--mailgun-key")
+	if m.Key == "" {
+		return nil, errors.New("--mailgun-key not set")
+	}
+	m.Domain, _ = g.ParamStr("--mailgun-domain")
+	if m.Domain == "" {
+		return nil, errors.New("--mailgun-domain not set")
+	}
+	m.URL, _ = g.ParamStr("--mailgun-url")
+	return m, nil
+}
+
+// Send implements the Sender interface
+func (m *Mailgun) Send(job *Mail) error {
+	form := url.Values{}
+	form.Set("from", (&mail.Address{Name: job.FromName, Address: job.From}).String())
+	form.Set("to", (&mail.Address{Name: job.ToName, Address: job.To}).String())
+	form.Set("subject", job.Subject)
+	if job.HTML != "" {
+		form.Set("html", job.HTML)
+	}
+	if job.Text != "" {
+		form.Set("text", job.Text)
+	}
+	if job.ReplyTo != "" {
+		form.Set("h:Reply-To", job.ReplyTo)
+	}
+	// custom variables are included in every webhook for the email
+	for k, v := range job.UniqueArgs {
+		form.Set("v:"+k, v)
+	}
+	form.Set("o:tag", flagsTag(job.Flags))
+
+	u := m.URL
+	if u == "" {
+		u = mailgunURL
+	}
+	u = fmt.Sprintf("%s/v3/%s/messages", u, url.PathEscape(m.Domain))
+	r, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	r.SetBasicAuth("api", m.Key)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, _, err = doHTTP("mailgun", m.Client, r)
+	return err
+}
@@ -0,0 +1,56 @@
+package sender
+
+import (
+	"net/http"
+	"net/http/httptest"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailgunSend(t *T) {
+	var r *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Nil(t, req.ParseForm())
+		r = req
+		w.Write([]byte(`{"id":"<1@test.com>","message":"Queued. Thank you."}`))
+	}))
+	defer srv.Close()
+
+	m := &Mailgun{Key: "key", Domain: "mg.test.com", URL: srv.URL}
+	require.Nil(t, m.Send(testMail()))
+
+	assert.Equal(t, "/v3/mg.test.com/messages", r.URL.Path)
+	_, pass, _ := r.BasicAuth()
+	assert.Equal(t, "key", pass)
+	assert.Equal(t, `"From" <from@test.com>`, r.PostForm.Get("from"))
+	assert.Equal(t, `"<To>" <to@test.com>`, r.PostForm.Get("to"))
+	assert.Equal(t, "Subject", r.PostForm.Get("subject"))
+	assert.Equal(t, "<b>hi</b>", r.PostForm.Get("html"))
+	assert.Equal(t, "hi", r.PostForm.Get("text"))
+	assert.Equal(t, "reply@test.com", r.PostForm.Get("h:Reply-To"))
+	assert.Equal(t, "abc", r.PostForm.Get("v:pmStatsID"))
+	assert.Equal(t, "flags-2", r.PostForm.Get("o:tag"))
+}
+
+func TestMailgunSendError(t *T) {
+	code := http.StatusBadRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		w.Write([]byte(`{"message":"'to' parameter is not a valid address"}`))
+	}))
+	defer srv.Close()
+
+	m := &Mailgun{Key: "key", Domain: "mg.test.com", URL: srv.URL}
+	err := m.Send(testMail())
+	require.NotNil(t, err)
+	assert.True(t, IsPermanent(err))
+	assert.Contains(t, err.Error(), "not a valid address")
+
+	for _, code = range []int{401, 429, 500, 503} {
+		err = m.Send(testMail())
+		require.NotNil(t, err)
+		assert.False(t, IsPermanent(err), "code %d", code)
+	}
+}
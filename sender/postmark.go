@@ -0,0 +1,113 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+
+	"github.com/levenlabs/golib/genapi"
+)
+
+// postmarkURL is the host that all Postmark API requests are made against
+const postmarkURL = "https://api.postmarkapp.com"
+
+// postmarkConfigErrors are the Postmark error codes which are caused by our
+// account or config rather than the email, so they aren't permanent
+var postmarkConfigErrors = map[int]bool{
+	10:  true, // bad or missing server token
+	400: true, // sender signature not found
+	401: true, // sender signature not confirmed
+	405: true, // not allowed to send
+	412: true, // account is pending
+	413: true, // account may not send
+}
+
+// Postmark is a Sender which sends emails using the Postmark email API
+type Postmark struct {
+	// Token is the Postmark server API token
+	Token string
+
+	// Stream is the message stream emails are sent through, which defaults to
+	// the stream named outbound
+	Stream string
+
+	// URL defaults to the Postmark API and can be changed for testing
+	URL string
+
+	// Client defaults to httpClient
+	Client *http.Client
+}
+
+type postmarkEmail struct {
+	From          string            `json:"From"`
+	To            string            `json:"To"`
+	ReplyTo       string            `json:"ReplyTo,omitempty"`
+	Subject       string            `json:"Subject"`
+	HTMLBody      string            `json:"HtmlBody,omitempty"`
+	TextBody      string            `json:"TextBody,omitempty"`
+	Tag           string            `json:"Tag,omitempty"`
+	Metadata      map[string]string `json:"Metadata,omitempty"`
+	MessageStream string            `json:"MessageStream,omitempty"`
+}
+
+type postmarkError struct {
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+}
+
+func newPostmark(g *genapi.GenAPI) (Sender, error) {
+	p := &Postmark{}
+	p.Token, _ = g.ParamStr("--postmark-token")
+	if p.Token == "" {
+		return nil, errors.New("--postmark-token not set")
+	}
+	p.Stream, _ = g.ParamStr("--postmark-stream")
+	return p, nil
+}
+
+// Send implements the Sender interface
+func (p *Postmark) Send(job *Mail) error {
+	e := postmarkEmail{
+		From:          (&mail.Address{Name: job.FromName, Address: job.From}).String(),
+		To:            (&mail.Address{Name: job.ToName, Address: job.To}).String(),
+		ReplyTo:       job.ReplyTo,
+		Subject:       job.Subject,
+		HTMLBody:      job.HTML,
+		TextBody:      job.Text,
+		Tag:           flagsTag(job.Flags),
+		Metadata:      job.UniqueArgs,
+		MessageStream: p.Stream,
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	u := p.URL
+	if u == "" {
+		u = postmarkURL
+	}
+	r, err := http.NewRequest("POST", u+"/email", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Postmark-Server-Token", p.Token)
+	_, body, err := doHTTP("postmark", p.Client, r)
+	if err == nil {
+		return nil
+	}
+	// Postmark returns 422 for every rejected email, the ErrorCode tells us
+	// whether or not it was the email's fault
+	if perr, ok := err.(*Error); ok && perr.StatusCode == http.StatusUnprocessableEntity {
+		var pe postmarkError
+		if json.Unmarshal(body, &pe) == nil {
+			perr.Message = pe.Message
+			perr.Permanent = !postmarkConfigErrors[pe.ErrorCode]
+		}
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package sender
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostmarkSend(t *T) {
+	var e postmarkEmail
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/email", r.URL.Path)
+		assert.Equal(t, "token", r.Header.Get("X-Postmark-Server-Token"))
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&e))
+		w.Write([]byte(`{"ErrorCode":0,"Message":"OK"}`))
+	}))
+	defer srv.Close()
+
+	p := &Postmark{Token: "token", Stream: "broadcast", URL: srv.URL}
+	require.Nil(t, p.Send(testMail()))
+
+	assert.Equal(t, `"From" <from@test.com>`, e.From)
+	assert.Equal(t, `"<To>" <to@test.com>`, e.To)
+	assert.Equal(t, "reply@test.com", e.ReplyTo)
+	assert.Equal(t, "Subject", e.Subject)
+	assert.Equal(t, "<b>hi</b>", e.HTMLBody)
+	assert.Equal(t, "hi", e.TextBody)
+	assert.Equal(t, "flags-2", e.Tag)
+	assert.Equal(t, map[string]string{"pmStatsID": "abc"}, e.Metadata)
+	assert.Equal(t, "broadcast", e.MessageStream)
+}
+
+func TestPostmarkSendError(t *T) {
+	var code int
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	p := &Postmark{Token: "token", URL: srv.URL}
+
+	code = http.StatusUnprocessableEntity
+	body = `{"ErrorCode":406,"Message":"You tried to send to a recipient that has been marked as inactive."}`
+	err := p.Send(testMail())
+	require.NotNil(t, err)
+	assert.True(t, IsPermanent(err))
+	assert.Contains(t, err.Error(), "inactive")
+
+	body = `{"ErrorCode":412,"Message":"Account is pending"}`
+	err = p.Send(testMail())
+	require.NotNil(t, err)
+	assert.False(t, IsPermanent(err))
+
+	code = http.StatusInternalServerError
+	body = ``
+	err = p.Send(testMail())
+	require.NotNil(t, err)
+	assert.False(t, IsPermanent(err))
+}
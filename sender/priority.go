@@ -0,0 +1,42 @@
+package sender
+
+// The priorities an email can be sent with. Each priority is sent from its own
+// queue so that emails of a lower priority never hold up higher ones
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+var (
+	// highPriorityFlags and lowPriorityFlags are the masks used to pick the
+	// priority of emails which weren't given one explicitly
+	highPriorityFlags int64
+	lowPriorityFlags  int64
+)
+
+// ValidPriority returns whether p can be used as a Mail's Priority. An empty
+// priority is valid and means it's picked by the email's flags
+func ValidPriority(p string) bool {
+	switch p {
+	case "", PriorityHigh, PriorityNormal, PriorityLow:
+		return true
+	}
+	return false
+}
+
+// PickPriority returns the priority the email should be sent with. If the
+// email has an explicit Priority that's used, otherwise it's picked by matching
+// the email's flags against --priority-high-flags and then
+// --priority-low-flags
+func PickPriority(job *Mail) string {
+	switch {
+	case job.Priority != "":
+		return job.Priority
+	case job.Flags&highPriorityFlags != 0:
+		return PriorityHigh
+	case job.Flags&lowPriorityFlags != 0:
+		return PriorityLow
+	}
+	return PriorityNormal
+}
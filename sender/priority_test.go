@@ -0,0 +1,33 @@
+package sender
+
+import (
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickPriority(t *T) {
+	defer func(h, l int64) {
+		highPriorityFlags, lowPriorityFlags = h, l
+	}(highPriorityFlags, lowPriorityFlags)
+	highPriorityFlags = 2
+	lowPriorityFlags = 4 | 8
+
+	job := testMail()
+	job.Flags = 16
+	assert.Equal(t, PriorityNormal, PickPriority(job))
+	job.Flags = 2 | 16
+	assert.Equal(t, PriorityHigh, PickPriority(job))
+	job.Flags = 8
+	assert.Equal(t, PriorityLow, PickPriority(job))
+	// high wins over low
+	job.Flags = 2 | 4
+	assert.Equal(t, PriorityHigh, PickPriority(job))
+	// an explicit priority wins over the flags
+	job.Priority = PriorityLow
+	assert.Equal(t, PriorityLow, PickPriority(job))
+
+	assert.True(t, ValidPriority(""))
+	assert.True(t, ValidPriority(PriorityHigh))
+	assert.False(t, ValidPriority("urgent"))
+}
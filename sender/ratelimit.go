@@ -0,0 +1,140 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when an email can't be sent because a send rate
+// limit wouldn't allow it within --send-rate-max-wait. The email wasn't
+// attempted so it should be tried again later without counting it as a
+// failure
+var ErrRateLimited = errors.New("send rate limit reached")
+
+var (
+	// sendLimit is the limit across all providers, it's nil if there's no
+	// limit
+	sendLimit *tokenBucket
+
+	// providerLimits holds the limit for each provider which has one. Routes
+	// through the same provider share its limit
+	providerLimits = map[string]*tokenBucket{}
+
+	// maxRateWait is the longest an email waits for a rate limit before
+	// ErrRateLimited is returned
+	maxRateWait = 5 * time.Second
+)
+
+// tokenBucket is a rate limiter which allows rate sends a second, with bursts
+// of up to a second's worth of sends
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	l      sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take waits for a token to become available and returns true, unless it
+// would have to wait longer than maxWait in which case it returns false
+// immediately. A nil tokenBucket always has tokens available
+func (b *tokenBucket) take(maxWait time.Duration) bool {
+	if b == nil {
+		return true
+	}
+	b.l.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		b.l.Unlock()
+		return false
+	}
+	// the token is reserved now, even if we have to wait for it, so that
+	// waiting senders are let through in order
+	b.tokens--
+	b.l.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
+
+// parseProviderRates parses a spec in the form of provider=rate,... into a
+// tokenBucket for each provider
+func parseProviderRates(spec string) (map[string]*tokenBucket, error) {
+	m := map[string]*tokenBucket{}
+	if strings.TrimSpace(spec) == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid provider rate %q", part)
+		}
+		name := part[:i]
+		if _, ok := senderFuncs[name]; !ok {
+			return nil, fmt.Errorf("unknown sender: %q", name)
+		}
+		rate, err := strconv.Atoi(part[i+1:])
+		if err != nil || rate < 1 {
+			return nil, fmt.Errorf("invalid rate for sender %q", name)
+		}
+		m[name] = newTokenBucket(rate)
+	}
+	return m, nil
+}
+
+// limitedSender is a Sender which is limited by its provider's rate limit
+type limitedSender struct {
+	Sender
+	limit *tokenBucket
+}
+
+// withLimit returns s limited by the rate limit of the provider, or s itself if
+// the provider doesn't have one
+func withLimit(provider string, s Sender) Sender {
+	b, ok := providerLimits[provider]
+	if !ok {
+		return s
+	}
+	return &limitedSender{Sender: s, limit: b}
+}
+
+// Send implements the Sender interface
+func (l *limitedSender) Send(job *Mail) error {
+	if !l.limit.take(maxRateWait) {
+		return ErrRateLimited
+	}
+	return l.Sender.Send(job)
+}
+
+// Throttle waits until the --send-rate limit allows another email to be sent.
+// ErrRateLimited is returned if that would take longer than
+// --send-rate-max-wait, in which case the email shouldn't be sent yet
+func Throttle() error {
+	if !sendLimit.take(maxRateWait) {
+		return ErrRateLimited
+	}
+	return nil
+}
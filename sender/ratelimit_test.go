@@ -0,0 +1,94 @@
+package sender
+
+import (
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *T) {
+	b := newTokenBucket(20)
+	for i := 0; i < 20; i++ {
+		assert.True(t, b.take(0))
+	}
+	// the burst is used up so the next one needs to wait 50ms
+	assert.False(t, b.take(0))
+	start := time.Now()
+	assert.True(t, b.take(100*time.Millisecond))
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	var nb *tokenBucket
+	assert.True(t, nb.take(0))
+}
+
+func TestLimitedThroughput(t *T) {
+	f := &fakeSender{}
+	r := testRouter([]int{0}, &limitedSender{Sender: f, limit: newTokenBucket(50)})
+
+	// 10 workers sending 100 emails at 50 a second with a burst of 50 should
+	// take about a second
+	start := time.Now()
+	jobs := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				assert.Nil(t, r.Send(testMail()))
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	took := time.Since(start)
+
+	assert.Equal(t, 100, f.count())
+	assert.True(t, took >= 900*time.Millisecond, "took %s", took)
+	assert.True(t, took < 2*time.Second, "took %s", took)
+}
+
+func TestRouterRateLimited(t *T) {
+	defer func(w time.Duration) { maxRateWait = w }(maxRateWait)
+	maxRateWait = 0
+
+	a := &fakeSender{}
+	b := &fakeSender{}
+	r := testRouter([]int{0, 0}, &limitedSender{Sender: a, limit: newTokenBucket(1)}, b)
+
+	require.Nil(t, r.Send(testMail()))
+	assert.Equal(t, 1, a.count())
+	// a is out of tokens so the email goes through b, without counting
+	// against a's breaker
+	require.Nil(t, r.Send(testMail()))
+	assert.Equal(t, 1, a.count())
+	assert.Equal(t, 1, b.count())
+	assert.Equal(t, 0, r.routes[0].breaker.failures)
+
+	// if every provider is limited then the email isn't sent at all
+	r = testRouter([]int{0}, &limitedSender{Sender: a, limit: newTokenBucket(1)})
+	require.Nil(t, r.Send(testMail()))
+	assert.Equal(t, ErrRateLimited, r.Send(testMail()))
+	assert.Equal(t, 2, a.count())
+}
+
+func TestParseProviderRates(t *T) {
+	m, err := parseProviderRates("sendgrid=100, mailgun=20")
+	require.Nil(t, err)
+	assert.Len(t, m, 2)
+	assert.Equal(t, float64(20), m["mailgun"].rate)
+
+	_, err = parseProviderRates("nope=1")
+	assert.NotNil(t, err)
+	_, err = parseProviderRates("sendgrid=0")
+	assert.NotNil(t, err)
+	m, err = parseProviderRates("")
+	require.Nil(t, err)
+	assert.Empty(t, m)
+}
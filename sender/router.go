@@ -0,0 +1,208 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/genapi"
+)
+
+// ErrNoSenders is returned by a router when every provider's circuit breaker is
+// open, so there was nothing to send through
+var ErrNoSenders = errors.New("no senders available")
+
+// breaker is a circuit breaker which opens after threshold consecutive
+// failures. Once cooldown has passed since it opened a single trial send is let
+// through, which either closes the breaker or opens it for another cooldown
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	l        sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func (b *breaker) allow() bool {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) success() {
+	b.l.Lock()
+	b.failures = 0
+	b.trial = false
+	b.l.Unlock()
+}
+
+// skip is called when a send that was allowed didn't actually happen, so a
+// trial send can be let through again
+func (b *breaker) skip() {
+	b.l.Lock()
+	b.trial = false
+	b.l.Unlock()
+}
+
+func (b *breaker) failure() {
+	b.l.Lock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+	b.l.Unlock()
+}
+
+// route is a single provider within a router. fallback is set on the --sender
+// providers a Route fails over to
+type route struct {
+	name     string
+	sender   Sender
+	weight   int
+	breaker  *breaker
+	fallback bool
+}
+
+// router is a Sender which splits emails across providers by their weights.
+// If the picked provider fails with an error that isn't permanent, or its
+// breaker is open, the email fails over to the rest of the providers in the
+// order they were configured in
+type router struct {
+	routes []*route
+	total  int
+}
+
+// newRouter parses a spec in the form of name[:weight],... into a router. If
+// none of the providers have a weight then the first gets all of the emails
+// and the rest are only failed over to
+func newRouter(g *genapi.GenAPI, spec string, threshold int, cooldown time.Duration) (*router, error) {
+	r := &router{}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		name, weight := part, 0
+		if i := strings.Index(part, ":"); i >= 0 {
+			name = part[:i]
+			w, err := strconv.Atoi(part[i+1:])
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight for sender %q", name)
+			}
+			weight = w
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("sender %q listed more than once", name)
+		}
+		seen[name] = true
+
+		s, err := newSender(g, name)
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, &route{
+			name:    name,
+			sender:  withLimit(name, s),
+			weight:  weight,
+			breaker: &breaker{threshold: threshold, cooldown: cooldown},
+		})
+		r.total += weight
+	}
+	return r, nil
+}
+
+// withPrimary returns a router which sends every email through s, and only
+// fails over to r's providers, in the order they were configured in, when s
+// fails. r's providers keep their breakers so their failures are shared with r
+func (r *router) withPrimary(name string, s Sender, threshold int, cooldown time.Duration) *router {
+	rr := &router{routes: []*route{{
+		name:    name,
+		sender:  s,
+		breaker: &breaker{threshold: threshold, cooldown: cooldown},
+	}}}
+	for _, rt := range r.routes {
+		// the fallbacks are only failed over to, never picked by weight
+		rr.routes = append(rr.routes, &route{
+			name:     rt.name,
+			sender:   rt.sender,
+			breaker:  rt.breaker,
+			fallback: true,
+		})
+	}
+	return rr
+}
+
+// order returns the routes in the order they should be tried for an email
+func (r *router) order() []*route {
+	first := 0
+	if r.total > 0 {
+		n := rand.Intn(r.total)
+		for i, rt := range r.routes {
+			if n < rt.weight {
+				first = i
+				break
+			}
+			n -= rt.weight
+		}
+	}
+	o := make([]*route, 0, len(r.routes))
+	o = append(o, r.routes[first])
+	for i, rt := range r.routes {
+		if i != first {
+			o = append(o, rt)
+		}
+	}
+	return o
+}
+
+// Send implements the Sender interface
+func (r *router) Send(job *Mail) error {
+	_, err := r.send(job)
+	return err
+}
+
+// send is like Send but also returns the provider which was last tried, which
+// is the one that sent the email if there was no error. nil is returned if
+// none of them were tried
+func (r *router) send(job *Mail) (*route, error) {
+	var last *route
+	err := ErrNoSenders
+	for _, rt := range r.order() {
+		if !rt.breaker.allow() {
+			continue
+		}
+		last = rt
+		err = rt.sender.Send(job)
+		if err == ErrRateLimited {
+			// the provider wasn't actually tried so it doesn't count against
+			// it, but the email can still go through another provider
+			rt.breaker.skip()
+			continue
+		}
+		if err == nil || IsPermanent(err) {
+			// a permanent error means the provider is up but didn't like the
+			// email, which every other provider would agree with
+			rt.breaker.success()
+			return rt, err
+		}
+		rt.breaker.failure()
+		llog.Warn("sender failed, failing over", llog.KV{
+			"sender":    rt.name,
+			"recipient": job.To,
+		}, llog.ErrKV(err))
+	}
+	return last, err
+}
@@ -0,0 +1,132 @@
+package sender
+
+import (
+	"errors"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSender is a Sender which returns err and counts how many emails it was
+// asked to send
+type fakeSender struct {
+	l   sync.Mutex
+	n   int
+	err error
+}
+
+func (f *fakeSender) Send(*Mail) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.n++
+	return f.err
+}
+
+func (f *fakeSender) count() int {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.n
+}
+
+func testRouter(weights []int, senders ...Sender) *router {
+	r := &router{}
+	for i, s := range senders {
+		r.routes = append(r.routes, &route{
+			name:    string(rune('a' + i)),
+			sender:  s,
+			weight:  weights[i],
+			breaker: &breaker{threshold: 2, cooldown: 50 * time.Millisecond},
+		})
+		r.total += weights[i]
+	}
+	return r
+}
+
+func TestRouterFailover(t *T) {
+	a := &fakeSender{err: errors.New("timeout")}
+	b := &fakeSender{}
+	r := testRouter([]int{0, 0}, a, b)
+
+	require.Nil(t, r.Send(testMail()))
+	require.Nil(t, r.Send(testMail()))
+	assert.Equal(t, 2, a.count())
+	assert.Equal(t, 2, b.count())
+
+	// a's breaker is now open so it's skipped
+	require.Nil(t, r.Send(testMail()))
+	assert.Equal(t, 2, a.count())
+	assert.Equal(t, 3, b.count())
+
+	// after the cooldown a gets a trial send, which succeeds and closes it
+	time.Sleep(60 * time.Millisecond)
+	a.err = nil
+	require.Nil(t, r.Send(testMail()))
+	require.Nil(t, r.Send(testMail()))
+	assert.Equal(t, 4, a.count())
+	assert.Equal(t, 3, b.count())
+}
+
+func TestRouterPermanent(t *T) {
+	perm := &Error{Provider: "a", StatusCode: 400, Permanent: true}
+	a := &fakeSender{err: perm}
+	b := &fakeSender{}
+	r := testRouter([]int{0, 0}, a, b)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, perm, r.Send(testMail()))
+	}
+	// permanent errors don't fail over or trip the breaker
+	assert.Equal(t, 3, a.count())
+	assert.Equal(t, 0, b.count())
+}
+
+func TestRouterAllOpen(t *T) {
+	a := &fakeSender{err: errors.New("a")}
+	b := &fakeSender{err: errors.New("b")}
+	r := testRouter([]int{0, 0}, a, b)
+
+	assert.NotNil(t, r.Send(testMail()))
+	assert.NotNil(t, r.Send(testMail()))
+	assert.Equal(t, ErrNoSenders, r.Send(testMail()))
+	assert.Equal(t, 2, a.count())
+	assert.Equal(t, 2, b.count())
+}
+
+func TestRouterWeights(t *T) {
+	a, b, c := &fakeSender{}, &fakeSender{}, &fakeSender{}
+	r := testRouter([]int{75, 25, 0}, a, b, c)
+	for i := 0; i < 4000; i++ {
+		require.Nil(t, r.Send(testMail()))
+	}
+	assert.InDelta(t, 3000, a.count(), 200)
+	assert.InDelta(t, 1000, b.count(), 200)
+	assert.Equal(t, 0, c.count())
+}
+
+func TestRouterWithPrimary(t *T) {
+	a := &fakeSender{}
+	b := &fakeSender{}
+	fallback := testRouter([]int{0, 0}, a, b)
+	p := &fakeSender{err: errors.New("timeout")}
+	r := fallback.withPrimary("p", p, 2, 50*time.Millisecond)
+
+	// the primary fails so the email fails over to the fallback in order
+	require.Nil(t, r.Send(testMail()))
+	assert.Equal(t, 1, p.count())
+	assert.Equal(t, 1, a.count())
+	assert.Equal(t, 0, b.count())
+
+	// once the primary works again the fallback isn't used
+	p.l.Lock()
+	p.err = nil
+	p.l.Unlock()
+	require.Nil(t, r.Send(testMail()))
+	assert.Equal(t, 2, p.count())
+	assert.Equal(t, 1, a.count())
+
+	// the fallback's breakers are shared with the fallback router
+	assert.True(t, r.routes[1].breaker == fallback.routes[0].breaker)
+}
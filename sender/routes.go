@@ -0,0 +1,188 @@
+package sender
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/golib/genapi"
+)
+
+// DefaultRoute is the name of the route used for emails which don't match any
+// of the routes in --routes
+const DefaultRoute = "default"
+
+// Route is a provider an email can be sent through, picked by the email's
+// flags. Use its Send rather than the embedded Sender's so that it's known
+// whether the email failed over to another route
+type Route struct {
+	Sender
+
+	// Name identifies the route and is stored with the email's stats. It's the
+	// provider and pool separated by a colon, or just the provider if the
+	// route has no pool
+	Name string
+
+	// Flags is the mask an email's flags are matched against
+	Flags int64
+}
+
+var (
+	routes       []*Route
+	defaultRoute *Route
+)
+
+// Send sends the email through the route and returns the name of the route it
+// was actually sent through, which is DefaultRoute if the route failed over to
+// the providers in --sender
+func (r *Route) Send(job *Mail) (string, error) {
+	rr, ok := r.Sender.(*router)
+	if !ok {
+		return r.Name, r.Sender.Send(job)
+	}
+	rt, err := rr.send(job)
+	if rt != nil && rt.fallback {
+		return DefaultRoute, err
+	}
+	return r.Name, err
+}
+
+// routable is implemented by the providers whose API key and pool can be
+// overridden per route. What a pool is depends on the provider
+type routable interface {
+	withRoute(key, pool string) (Sender, error)
+}
+
+func (s *SendGrid) withRoute(key, pool string) (Sender, error) {
+	ss := *s
+	if key != "" {
+		ss.Key = key
+	}
+	if pool != "" {
+		ss.IPPool = pool
+	}
+	return &ss, nil
+}
+
+// Mailgun assigns IP pools to domains so the pool is the sending domain
+func (m *Mailgun) withRoute(key, pool string) (Sender, error) {
+	mm := *m
+	if key != "" {
+		mm.Key = key
+	}
+	if pool != "" {
+		mm.Domain = pool
+	}
+	return &mm, nil
+}
+
+// SES assigns dedicated IP pools to configuration sets so the pool is the
+// configuration set, and the key is the access key and secret key separated by
+// a colon
+func (s *SES) withRoute(key, pool string) (Sender, error) {
+	ss := *s
+	if key != "" {
+		i := strings.Index(key, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("ses route key must be in the form accessKey:secretKey")
+		}
+		ss.AccessKey, ss.SecretKey = key[:i], key[i+1:]
+	}
+	if pool != "" {
+		ss.ConfigurationSet = pool
+	}
+	return &ss, nil
+}
+
+// Postmark separates reputation by message stream so the pool is the stream
+func (p *Postmark) withRoute(key, pool string) (Sender, error) {
+	pp := *p
+	if key != "" {
+		pp.Token = key
+	}
+	if pool != "" {
+		pp.Stream = pool
+	}
+	return &pp, nil
+}
+
+// parseRoutes parses a spec in the form of flags=provider[:pool[:key]],... into
+// routes in the same order. Each route has its own circuit breaker. The routes
+// named in failoverSpec, a comma separated list of route names, fail over to
+// the providers in fallback, the --sender router, when their provider fails.
+// Since those send with their own pool and key the rest never do
+func parseRoutes(g *genapi.GenAPI, spec, failoverSpec string, fallback *router, threshold int, cooldown time.Duration) ([]*Route, error) {
+	failover := map[string]bool{}
+	for _, name := range strings.Split(failoverSpec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			failover[name] = true
+		}
+	}
+
+	var rs []*Route
+	if strings.TrimSpace(spec) == "" {
+		if len(failover) > 0 {
+			return nil, fmt.Errorf("--routes-failover set without any --routes")
+		}
+		return rs, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid route %q", part)
+		}
+		flags, err := strconv.ParseInt(part[:i], 10, 64)
+		if err != nil || flags <= 0 {
+			return nil, fmt.Errorf("invalid flags for route %q", part)
+		}
+		pieces := strings.SplitN(part[i+1:], ":", 3)
+		for len(pieces) < 3 {
+			pieces = append(pieces, "")
+		}
+		provider, pool, key := pieces[0], pieces[1], pieces[2]
+
+		s, err := newSender(g, provider)
+		if err != nil {
+			return nil, err
+		}
+		if pool != "" || key != "" {
+			r, ok := s.(routable)
+			if !ok {
+				return nil, fmt.Errorf("%s routes can't have a pool or key", provider)
+			}
+			if s, err = r.withRoute(key, pool); err != nil {
+				return nil, err
+			}
+		}
+
+		name := provider
+		if pool != "" {
+			name += ":" + pool
+		}
+		fb := &router{}
+		if failover[name] {
+			fb = fallback
+			delete(failover, name)
+		}
+		rr := fb.withPrimary(name, withLimit(provider, s), threshold, cooldown)
+		rs = append(rs, &Route{Sender: rr, Name: name, Flags: flags})
+	}
+	for name := range failover {
+		return nil, fmt.Errorf("unknown route %q in --routes-failover", name)
+	}
+	return rs, nil
+}
+
+// PickRoute returns the Route the email should be sent through, which is the
+// first route sharing any flags with the email. If there isn't one then the
+// default route, made up of the providers in --sender, is returned
+func PickRoute(job *Mail) *Route {
+	for _, r := range routes {
+		if r.Flags&job.Flags != 0 {
+			return r
+		}
+	}
+	return defaultRoute
+}
@@ -0,0 +1,75 @@
+package sender
+
+import (
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPickRoute(t *T) {
+	defer func(rs []*Route, d *Route) {
+		routes, defaultRoute = rs, d
+	}(routes, defaultRoute)
+
+	defaultRoute = &Route{Name: DefaultRoute}
+	routes = []*Route{
+		{Name: "sendgrid:transactional", Flags: 2 | 8},
+		{Name: "mailgun", Flags: 4},
+	}
+
+	job := testMail()
+	job.Flags = 8
+	assert.Equal(t, "sendgrid:transactional", PickRoute(job).Name)
+	job.Flags = 4 | 8
+	assert.Equal(t, "sendgrid:transactional", PickRoute(job).Name)
+	job.Flags = 4 | 16
+	assert.Equal(t, "mailgun", PickRoute(job).Name)
+	job.Flags = 16
+	assert.Equal(t, DefaultRoute, PickRoute(job).Name)
+}
+
+func TestWithRoute(t *T) {
+	sg := &SendGrid{Key: "key", IPPool: "pool"}
+	s, err := sg.withRoute("", "other")
+	require.Nil(t, err)
+	assert.Equal(t, &SendGrid{Key: "key", IPPool: "other"}, s)
+	// the original shouldn't be changed
+	assert.Equal(t, "pool", sg.IPPool)
+
+	ses := &SES{AccessKey: "a", SecretKey: "s"}
+	s, err = ses.withRoute("a2:s2:s2", "set")
+	require.Nil(t, err)
+	assert.Equal(t, &SES{AccessKey: "a2", SecretKey: "s2:s2", ConfigurationSet: "set"}, s)
+	_, err = ses.withRoute("nope", "")
+	assert.NotNil(t, err)
+}
+
+func TestRouteSend(t *T) {
+	fallback := testRouter([]int{0}, &fakeSender{})
+	p := &fakeSender{err: errors.New("timeout")}
+
+	// routes only fail over when they're configured to
+	r := &Route{Name: "p:pool", Sender: (&router{}).withPrimary("p:pool", p, 2, time.Minute)}
+	_, err := r.Send(testMail())
+	assert.NotNil(t, err)
+
+	r = &Route{Name: "p:pool", Sender: fallback.withPrimary("p:pool", p, 2, time.Minute)}
+	via, err := r.Send(testMail())
+	require.Nil(t, err)
+	assert.Equal(t, DefaultRoute, via)
+
+	p.l.Lock()
+	p.err = nil
+	p.l.Unlock()
+	via, err = r.Send(testMail())
+	require.Nil(t, err)
+	assert.Equal(t, "p:pool", via)
+
+	// the default route is always sent through itself
+	via, err = (&Route{Name: DefaultRoute, Sender: fallback}).Send(testMail())
+	require.Nil(t, err)
+	assert.Equal(t, DefaultRoute, via)
+}
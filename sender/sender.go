@@ -0,0 +1,185 @@
+// Package sender manages actually sending the emails for the postmaster
+package sender
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/genapi"
+	"github.com/levenlabs/golib/rpcutil"
+	"github.com/levenlabs/golib/timeutil"
+	"github.com/levenlabs/postmaster/ga"
+	"gopkg.in/validator.v2"
+)
+
+// Mail encompasses an email that is intended to be sent
+type Mail struct {
+	// To is the email address of the recipient
+	To string `json:"to" validate:"email,nonzero,max=256"`
+
+	// ToName is optional and represents the recipeient's name
+	ToName string `json:"toName,omitempty" validate:"max=256"`
+
+	// From is the email address of the sender
+	From string `json:"from" validate:"email,nonzero,max=256"`
+
+	// FromName is optional and represents the name of the sender
+	FromName string `json:"fromName,omitempty" validate:"max=256"`
+
+	// Subject is the subject of the email
+	Subject string `json:"subject" validate:"nonzero,max=998"` // RFC 5322 says not longer than 998
+
+	// HTML is the HTML body of the email and is required unless Text is sent
+	HTML string `json:"html,omitempty" validate:"max=2097152"` //2MB
+
+	// Text is the plain-text body and is required unless HTML is sent
+	Text string `json:"text,omitempty" validate:"max=2097152"` //2MB
+
+	// ReplyTo is the Reply-To email address for the email
+	ReplyTo string `json:"replyTo,omitempty" validate:"email,max=256"`
+
+	// UniqueArgs are the SMTP unique arguments passed onto sendgrid
+	// Note: pmStatsID is a reserved key and is used for stats recording
+	UniqueArgs map[string]string `json:"uniqueArgs,omitempty" validate:"argsMap=max=256"`
+
+	// Flags represent the category flags for this email and are used to
+	// determine if the recipient has blocked this category of email
+	Flags int64 `json:"flags"`
+
+	// UniqueID is an optional uniqueID for this email that will be stored with
+	// the email stats and can be used to later query when the last email with
+	// this ID was sent
+	UniqueID string `json:"uniqueID,omitempty" validate:"max=256"`
+
+	// MinInterval is optional and is the number of seconds that must have
+	// passed since the last email with the same UniqueID was sent to the
+	// recipient, otherwise this email is skipped. UniqueID is required with it
+	MinInterval int64 `json:"minInterval,omitempty" validate:"min=0"`
+
+	// SendAt is optional and is the earliest time the email can be sent
+	SendAt *timeutil.Timestamp `json:"sendAt,omitempty"`
+
+	// ExpiresAt is optional and is the latest time the email can be sent,
+	// after which it's dropped
+	ExpiresAt *timeutil.Timestamp `json:"expiresAt,omitempty"`
+
+	// TTL is optional and is the number of seconds after it's enqueued, or
+	// after SendAt if it's scheduled, that the email expires. It's converted
+	// into ExpiresAt when the email is enqueued
+	TTL int64 `json:"ttl,omitempty" validate:"min=0"`
+
+	// Priority is optional and is either high, normal or low. If it's not
+	// sent then it's picked using the email's flags
+	Priority string `json:"priority,omitempty"`
+
+	// IdempotencyKey is optional and if it's sent again within
+	// --idempotency-ttl the email isn't queued again
+	IdempotencyKey string `json:"idempotencyKey,omitempty" validate:"max=256"`
+}
+
+// Sender is implemented by each email provider that the postmaster is able to
+// send through
+type Sender interface {
+	// Send hands the Mail off to the provider for delivery
+	Send(*Mail) error
+}
+
+// senderFuncs holds the constructor for every provider that can be picked
+// with --sender. Each constructor reads its own params off of the GenAPI.
+var senderFuncs = map[string]func(*genapi.GenAPI) (Sender, error){
+	"sendgrid": newSendGrid,
+	"smtp":     newSMTP,
+	"mailgun":  newMailgun,
+	"ses":      newSES,
+	"postmark": newPostmark,
+}
+
+func init() {
+	ga.GA.AppendInit(func(g *genapi.GenAPI) {
+		spec, _ := g.ParamStr("--sender")
+		threshold, _ := g.ParamInt("--sender-breaker-threshold")
+		if threshold < 1 {
+			llog.Fatal("--sender-breaker-threshold must be at least 1")
+		}
+		cooldownStr, _ := g.ParamStr("--sender-breaker-cooldown")
+		cooldown, err := time.ParseDuration(cooldownStr)
+		if err != nil {
+			llog.Fatal("invalid --sender-breaker-cooldown", llog.ErrKV(err))
+		}
+		if rate, _ := g.ParamInt("--send-rate"); rate > 0 {
+			sendLimit = newTokenBucket(rate)
+		}
+		ratesSpec, _ := g.ParamStr("--provider-rates")
+		if providerLimits, err = parseProviderRates(ratesSpec); err != nil {
+			llog.Fatal("invalid --provider-rates", llog.KV{"rates": ratesSpec}, llog.ErrKV(err))
+		}
+		waitStr, _ := g.ParamStr("--send-rate-max-wait")
+		if maxRateWait, err = time.ParseDuration(waitStr); err != nil {
+			llog.Fatal("invalid --send-rate-max-wait", llog.ErrKV(err))
+		}
+
+		r, err := newRouter(g, spec, threshold, cooldown)
+		if err != nil {
+			llog.Fatal("error setting up sender", llog.KV{"sender": spec}, llog.ErrKV(err))
+		}
+		defaultRoute = &Route{Sender: r, Name: DefaultRoute}
+
+		routesSpec, _ := g.ParamStr("--routes")
+		failoverSpec, _ := g.ParamStr("--routes-failover")
+		if routes, err = parseRoutes(g, routesSpec, failoverSpec, r, threshold, cooldown); err != nil {
+			llog.Fatal("error setting up routes", llog.KV{"routes": routesSpec}, llog.ErrKV(err))
+		}
+
+		hf, _ := g.ParamInt("--priority-high-flags")
+		highPriorityFlags = int64(hf)
+		lf, _ := g.ParamInt("--priority-low-flags")
+		lowPriorityFlags = int64(lf)
+
+		rpcutil.InstallCustomValidators()
+		validator.SetValidationFunc("argsMap", validateArgsMap)
+	})
+}
+
+// newSender returns a new Sender for the provider with the given name
+func newSender(g *genapi.GenAPI, name string) (Sender, error) {
+	fn, ok := senderFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sender: %q", name)
+	}
+	return fn(g)
+}
+
+// Send takes a Mail struct and sends it through the Route picked for it
+func Send(job *Mail) error {
+	_, err := PickRoute(job).Send(job)
+	return err
+}
+
+// validateArgsMap maps over the args map and validates each key and value in
+// it using the passed in tag
+func validateArgsMap(v interface{}, param string) error {
+	vv := reflect.ValueOf(v)
+	if vv.Kind() == reflect.Ptr {
+		vv = vv.Elem()
+	}
+
+	if k := vv.Kind(); k != reflect.Map {
+		return fmt.Errorf("non-array type: %s", k)
+	}
+
+	ks := vv.MapKeys()
+	for _, k := range ks {
+		//first check the key
+		if err := validator.Valid(k.Interface(), param); err != nil {
+			return fmt.Errorf("invalid key %s: %s", k.String(), err)
+		}
+		//now check the value
+		kv := vv.MapIndex(k).Interface()
+		if err := validator.Valid(kv, param); err != nil {
+			return fmt.Errorf("invalid value at key %s: %s", k.String(), err)
+		}
+	}
+	return nil
+}
@@ -1,83 +1,45 @@
-// Package sender manages actually sending the emails for the postmaster
 package sender
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
-	"reflect"
 	"strings"
 
-	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/golib/genapi"
-	"github.com/levenlabs/golib/rpcutil"
-	"github.com/levenlabs/postmaster/ga"
+	"github.com/sendgrid/rest"
 	sendgrid "github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
-	"gopkg.in/validator.v2"
 )
 
-var (
-	sgKey  string
-	sgPool string
-)
-
-// Mail encompasses an email that is intended to be sent
-type Mail struct {
-	// To is the email address of the recipient
-	To string `json:"to" validate:"email,nonzero,max=256"`
-
-	// ToName is optional and represents the recipeient's name
-	ToName string `json:"toName,omitempty" validate:"max=256"`
-
-	// From is the email address of the sender
-	From string `json:"from" validate:"email,nonzero,max=256"`
-
-	// FromName is optional and represents the name of the sender
-	FromName string `json:"fromName,omitempty" validate:"max=256"`
-
-	// Subject is the subject of the email
-	Subject string `json:"subject" validate:"nonzero,max=998"` // RFC 5322 says not longer than 998
+// sendGridURL is the host that all SendGrid API requests are made against
+const sendGridURL = "https://api.sendgrid.com"
 
-	// HTML is the HTML body of the email and is required unless Text is sent
-	HTML string `json:"html,omitempty" validate:"max=2097152"` //2MB
+// SendGrid is a Sender which sends emails using the SendGrid v3 API
+type SendGrid struct {
+	// Key is the SendGrid API key
+	Key string
 
-	// Text is the plain-text body and is required unless HTML is sent
-	Text string `json:"text,omitempty" validate:"max=2097152"` //2MB
+	// IPPool is optional and is the SendGrid IP pool all emails come from
+	IPPool string
 
-	// ReplyTo is the Reply-To email address for the email
-	ReplyTo string `json:"replyTo,omitempty" validate:"email,max=256"`
+	// URL defaults to the SendGrid API and can be changed for testing
+	URL string
 
-	// UniqueArgs are the SMTP unique arguments passed onto sendgrid
-	// Note: pmStatsID is a reserved key and is used for stats recording
-	UniqueArgs map[string]string `json:"uniqueArgs,omitempty" validate:"argsMap=max=256"`
-
-	// Flags represent the category flags for this email and are used to
-	// determine if the recipient has blocked this category of email
-	Flags int64 `json:"flags"`
-
-	// UniqueID is an optional uniqueID for this email that will be stored with
-	// the email stats and can be used to later query when the last email with
-	// this ID was sent
-	UniqueID string `json:"uniqueID,omitempty" validate:"max=256"`
+	// Client defaults to one using httpClient
+	Client *rest.Client
 }
 
-func init() {
-	ga.GA.AppendInit(func(g *genapi.GenAPI) {
-		key, _ := g.ParamStr("--sendgrid-key")
-		if key == "" {
-			llog.Fatal("--sendgrid-key not set")
-		}
-		sgKey = key
-		sgPool, _ = g.ParamStr("--sendgrid-ip-pool")
-
-		rpcutil.InstallCustomValidators()
-		validator.SetValidationFunc("argsMap", validateArgsMap)
-	})
+func newSendGrid(g *genapi.GenAPI) (Sender, error) {
+	key, _ := g.ParamStr("--sendgrid-key")
+	if key == "" {
+		return nil, errors.New("--sendgrid-key not set")
+	}
+	pool, _ := g.ParamStr("--sendgrid-ip-pool")
+	return &SendGrid{Key: key, IPPool: pool}, nil
 }
 
-// Send takes a Mail struct and sends it to sendgrid
-func Send(job *Mail) error {
+// Send implements the Sender interface
+func (s *SendGrid) Send(job *Mail) error {
 	msg := mail.NewV3Mail()
 	msg.SetFrom(mail.NewEmail(job.FromName, job.From))
 	if job.ReplyTo != "" {
@@ -106,45 +68,28 @@ func Send(job *Mail) error {
 			msg.SetCustomArg(k, v)
 		}
 	}
-	if sgPool != "" {
-		msg.SetIPPoolID(sgPool)
+	if s.IPPool != "" {
+		msg.SetIPPoolID(s.IPPool)
+	}
+
+	u := s.URL
+	if u == "" {
+		u = sendGridURL
+	}
+	c := s.Client
+	if c == nil {
+		// rest.DefaultClient doesn't have a timeout
+		c = &rest.Client{HTTPClient: httpClient}
 	}
-	req := sendgrid.GetRequest(sgKey, "/v3/mail/send", "https://api.sendgrid.com")
+	req := sendgrid.GetRequest(s.Key, "/v3/mail/send", u)
 	req.Method = "POST"
 	req.Body = mail.GetRequestBody(msg)
-	resp, err := sendgrid.API(req)
+	resp, err := c.API(req)
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != http.StatusAccepted {
-		return errors.New(resp.Body)
-	}
-	return nil
-}
-
-// validateArgsMap maps over the args map and validates each key and value in
-// it using the passed in tag
-func validateArgsMap(v interface{}, param string) error {
-	vv := reflect.ValueOf(v)
-	if vv.Kind() == reflect.Ptr {
-		vv = vv.Elem()
-	}
-
-	if k := vv.Kind(); k != reflect.Map {
-		return fmt.Errorf("non-array type: %s", k)
-	}
-
-	ks := vv.MapKeys()
-	for _, k := range ks {
-		//first check the key
-		if err := validator.Valid(k.Interface(), param); err != nil {
-			return fmt.Errorf("invalid key %s: %s", k.String(), err)
-		}
-		//now check the value
-		kv := vv.MapIndex(k).Interface()
-		if err := validator.Valid(kv, param); err != nil {
-			return fmt.Errorf("invalid value at key %s: %s", k.String(), err)
-		}
+		return newHTTPError("sendgrid", resp.StatusCode, resp.Body)
 	}
 	return nil
 }
@@ -1,33 +1,75 @@
 package sender
 
 import (
-	"github.com/levenlabs/golib/testutil"
-	"github.com/stretchr/testify/assert"
-	"gopkg.in/validator.v2"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	. "testing"
-)
 
-func TestValidation(t *T) {
-	s := &Mail{}
-	assert.NotNil(t, validator.Validate(s))
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
-	s = &Mail{
-		To:      "fake",
-		From:    "fake@gmail.com",
-		Subject: testutil.RandStr(),
+func testMail() *Mail {
+	return &Mail{
+		To:         "to@test.com",
+		ToName:     "<To>",
+		From:       "from@test.com",
+		FromName:   "From",
+		Subject:    "Subject",
+		HTML:       "<b>hi</b>",
+		Text:       "hi",
+		ReplyTo:    "reply@test.com",
+		UniqueArgs: map[string]string{"pmStatsID": "abc"},
+		Flags:      2,
 	}
-	assert.NotNil(t, validator.Validate(s))
+}
 
-	s = &Mail{
-		To:      "fake@gmail.com",
-		From:    "fake",
-		Subject: testutil.RandStr(),
-	}
-	assert.NotNil(t, validator.Validate(s))
+func TestSendGridSend(t *T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/mail/send", r.URL.Path)
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
 
-	s = &Mail{
-		To:   "fake@gmail.com",
-		From: "fake@gmail.com",
-	}
-	assert.NotNil(t, validator.Validate(s))
+	s := &SendGrid{Key: "key", IPPool: "pool", URL: srv.URL}
+	require.Nil(t, s.Send(testMail()))
+
+	assert.Equal(t, "Subject", body["subject"])
+	assert.Equal(t, "pool", body["ip_pool_name"])
+	assert.Equal(t, map[string]interface{}{"pmStatsID": "abc"}, body["custom_args"])
+	p := body["personalizations"].([]interface{})[0].(map[string]interface{})
+	to := p["to"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "to@test.com", to["email"])
+	assert.Equal(t, "To", to["name"])
+	assert.Len(t, body["content"], 2)
+}
+
+func TestSendGridSendError(t *T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errors":[{"message":"bad"}]}`))
+	}))
+	defer srv.Close()
+
+	s := &SendGrid{Key: "key", URL: srv.URL}
+	err := s.Send(testMail())
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad")
+	assert.True(t, IsPermanent(err))
+}
+
+func TestSendGridSendRetryable(t *T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	s := &SendGrid{Key: "key", URL: srv.URL}
+	err := s.Send(testMail())
+	require.NotNil(t, err)
+	assert.False(t, IsPermanent(err))
 }
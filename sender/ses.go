@@ -0,0 +1,229 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/golib/genapi"
+)
+
+// sesTemporaryErrors are the SES error types which aren't caused by the email
+// itself and so aren't permanent, even though SES returns them as 400s
+var sesTemporaryErrors = map[string]bool{
+	"TooManyRequestsException":           true,
+	"LimitExceededException":             true,
+	"SendingPausedException":             true,
+	"AccountSuspendedException":          true,
+	"MailFromDomainNotVerifiedException": true,
+}
+
+// sesTagInvalid matches the characters that aren't allowed in SES tag names
+// and values
+var sesTagInvalid = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// SES is a Sender which sends emails using the Amazon SES v2 SendEmail API
+type SES struct {
+	// Region is the AWS region SES is used in, such as us-east-1
+	Region string
+
+	// AccessKey and SecretKey are the AWS credentials used to sign requests
+	AccessKey string
+	SecretKey string
+
+	// ConfigurationSet is optional and is the SES configuration set that
+	// emails are sent with
+	ConfigurationSet string
+
+	// URL defaults to the SES API for Region and can be changed for testing
+	URL string
+
+	// Client defaults to httpClient
+	Client *http.Client
+}
+
+type sesContent struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset"`
+}
+
+type sesTag struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type sesEmail struct {
+	FromEmailAddress string `json:"FromEmailAddress"`
+	Destination      struct {
+		ToAddresses []string `json:"ToAddresses"`
+	} `json:"Destination"`
+	ReplyToAddresses []string `json:"ReplyToAddresses,omitempty"`
+	Content          struct {
+		Simple struct {
+			Subject sesContent `json:"Subject"`
+			Body    struct {
+				HTML *sesContent `json:"Html,omitempty"`
+				Text *sesContent `json:"Text,omitempty"`
+			} `json:"Body"`
+		} `json:"Simple"`
+	} `json:"Content"`
+	EmailTags            []sesTag `json:"EmailTags,omitempty"`
+	ConfigurationSetName string   `json:"ConfigurationSetName,omitempty"`
+}
+
+func newSES(g *genapi.GenAPI) (Sender, error) {
+	s := &SES{}
+	s.Region, _ = g.ParamStr("--ses-region")
+	s.AccessKey, _ = g.ParamStr("--ses-access-key")
+	s.SecretKey, _ = g.ParamStr("--ses-secret-key")
+	if s.Region == "" || s.AccessKey == "" || s.SecretKey == "" {
+		return nil, errors.New("--ses-region, --ses-access-key and --ses-secret-key must be set")
+	}
+	s.ConfigurationSet, _ = g.ParamStr("--ses-configuration-set")
+	return s, nil
+}
+
+// Send implements the Sender interface
+func (s *SES) Send(job *Mail) error {
+	e := sesEmail{
+		FromEmailAddress:     (&mail.Address{Name: job.FromName, Address: job.From}).String(),
+		ConfigurationSetName: s.ConfigurationSet,
+	}
+	e.Destination.ToAddresses = []string{
+		(&mail.Address{Name: job.ToName, Address: job.To}).String(),
+	}
+	if job.ReplyTo != "" {
+		e.ReplyToAddresses = []string{job.ReplyTo}
+	}
+	e.Content.Simple.Subject = sesContent{job.Subject, "UTF-8"}
+	if job.HTML != "" {
+		e.Content.Simple.Body.HTML = &sesContent{job.HTML, "UTF-8"}
+	}
+	if job.Text != "" {
+		e.Content.Simple.Body.Text = &sesContent{job.Text, "UTF-8"}
+	}
+	// tags are the only metadata SES passes on to event destinations, but
+	// they're limited in what characters they can contain
+	e.EmailTags = append(e.EmailTags, sesTag{"flags", fmt.Sprint(job.Flags)})
+	for k, v := range job.UniqueArgs {
+		e.EmailTags = append(e.EmailTags, sesTag{
+			Name:  sesTagInvalid.ReplaceAllString(k, "_"),
+			Value: sesTagInvalid.ReplaceAllString(v, "_"),
+		})
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	u := s.URL
+	if u == "" {
+		u = fmt.Sprintf("https://email.%s.amazonaws.com", s.Region)
+	}
+	r, err := http.NewRequest("POST", u+"/v2/email/outbound-emails", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	signV4(r, b, s.AccessKey, s.SecretKey, s.Region, "ses", time.Now())
+
+	resp, body, err := doHTTP("ses", s.Client, r)
+	if perr, ok := err.(*Error); ok {
+		typ := resp.Header.Get("X-Amzn-ErrorType")
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &e) == nil {
+			if typ == "" {
+				typ = e.Type
+			}
+			if e.Message != "" {
+				perr.Message = e.Message
+			}
+		}
+		// the type can be in the form of Type:http://internal.amazon.com/...
+		typ = strings.SplitN(typ, ":", 2)[0]
+		if sesTemporaryErrors[typ] {
+			perr.Permanent = false
+		}
+		if typ != "" {
+			perr.Message = typ + ": " + perr.Message
+		}
+	}
+	return err
+}
+
+// signV4 signs the request using AWS Signature Version 4, signing every
+// header that's been set on the request along with host
+func signV4(r *http.Request, body []byte, accessKey, secretKey, region, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	r.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": r.URL.Host}
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders bytes.Buffer
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonReq := strings.Join([]string{
+		r.Method,
+		path,
+		r.URL.Query().Encode(),
+		canonHeaders.String(),
+		signed,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(reqHash[:]),
+	}, "\n")
+
+	k := hmacSHA256([]byte("AWS4"+secretKey), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, sig,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,83 @@
+package sender
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignV4(t *T) {
+	// get-vanilla from the AWS Signature Version 4 test suite
+	r, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	require.Nil(t, err)
+	ts, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	signV4(r, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", ts)
+	assert.Equal(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		r.Header.Get("Authorization"),
+	)
+}
+
+func TestSESSend(t *T) {
+	var e sesEmail
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/email/outbound-emails", r.URL.Path)
+		auth = r.Header.Get("Authorization")
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&e))
+		w.Write([]byte(`{"MessageId":"abc"}`))
+	}))
+	defer srv.Close()
+
+	s := &SES{
+		Region:           "us-east-1",
+		AccessKey:        "access",
+		SecretKey:        "secret",
+		ConfigurationSet: "transactional",
+		URL:              srv.URL,
+	}
+	job := testMail()
+	job.UniqueArgs["some key"] = "some value"
+	require.Nil(t, s.Send(job))
+
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/"))
+	assert.Contains(t, auth, "/us-east-1/ses/aws4_request")
+	assert.Equal(t, `"From" <from@test.com>`, e.FromEmailAddress)
+	assert.Equal(t, []string{`"<To>" <to@test.com>`}, e.Destination.ToAddresses)
+	assert.Equal(t, []string{"reply@test.com"}, e.ReplyToAddresses)
+	assert.Equal(t, "Subject", e.Content.Simple.Subject.Data)
+	assert.Equal(t, "<b>hi</b>", e.Content.Simple.Body.HTML.Data)
+	assert.Equal(t, "hi", e.Content.Simple.Body.Text.Data)
+	assert.Equal(t, "transactional", e.ConfigurationSetName)
+	assert.Contains(t, e.EmailTags, sesTag{"flags", "2"})
+	assert.Contains(t, e.EmailTags, sesTag{"pmStatsID", "abc"})
+	assert.Contains(t, e.EmailTags, sesTag{"some_key", "some_value"})
+}
+
+func TestSESSendError(t *T) {
+	var typ string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amzn-ErrorType", typ)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"nope"}`))
+	}))
+	defer srv.Close()
+	s := &SES{Region: "us-east-1", AccessKey: "a", SecretKey: "s", URL: srv.URL}
+
+	typ = "MessageRejected:http://internal.amazon.com/coral/com.amazonaws.sesv2/"
+	err := s.Send(testMail())
+	require.NotNil(t, err)
+	assert.True(t, IsPermanent(err))
+	assert.Contains(t, err.Error(), "MessageRejected: nope")
+
+	typ = "TooManyRequestsException"
+	err = s.Send(testMail())
+	require.NotNil(t, err)
+	assert.False(t, IsPermanent(err))
+}
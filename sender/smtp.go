@@ -0,0 +1,314 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/golib/genapi"
+)
+
+// smtpTimeout is the longest a whole SMTP conversation is allowed to take
+const smtpTimeout = 30 * time.Second
+
+// SMTP is a Sender which delivers emails to an SMTP relay, such as a local
+// postfix or MailHog
+type SMTP struct {
+	// Addr is the host:port of the relay
+	Addr string
+
+	// Username and Password are used to authenticate with the relay, no
+	// authentication is done if Username is empty
+	Username string
+	Password string
+
+	// Auth is the SASL mechanism used to authenticate, either plain or login
+	Auth string
+
+	// SkipStartTLS allows sending over an unencrypted connection when the
+	// relay doesn't support STARTTLS. It should only be used for local relays
+	SkipStartTLS bool
+
+	// TLSConfig is optional and is used when upgrading with STARTTLS
+	TLSConfig *tls.Config
+
+	// Hostname is sent with EHLO and defaults to the machine's hostname
+	Hostname string
+}
+
+func newSMTP(g *genapi.GenAPI) (Sender, error) {
+	s := &SMTP{}
+	s.Addr, _ = g.ParamStr("--smtp-addr")
+	if s.Addr == "" {
+		return nil, errors.New("--smtp-addr not set")
+	}
+	s.Username, _ = g.ParamStr("--smtp-user")
+	s.Password, _ = g.ParamStr("--smtp-pass")
+	s.Auth, _ = g.ParamStr("--smtp-auth")
+	if s.Auth != "plain" && s.Auth != "login" {
+		return nil, fmt.Errorf("invalid --smtp-auth: %q", s.Auth)
+	}
+	s.SkipStartTLS = g.ParamFlag("--smtp-skip-starttls")
+	return s, nil
+}
+
+// Send implements the Sender interface
+func (s *SMTP) Send(job *Mail) error {
+	return smtpError(s.send(job))
+}
+
+// smtpError converts an error returned by the relay into an *Error. 5xx replies
+// are permanent except for the authentication ones, which are caused by our
+// config rather than the email
+func smtpError(err error) error {
+	terr, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+	var perm bool
+	switch terr.Code {
+	case 530, 534, 535, 538:
+	default:
+		perm = terr.Code >= 500
+	}
+	return &Error{
+		Provider:   "smtp",
+		StatusCode: terr.Code,
+		Message:    terr.Msg,
+		Permanent:  perm,
+	}
+}
+
+func (s *SMTP) send(job *Mail) error {
+	msg, err := buildMessage(job)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", s.Addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	hostname := s.Hostname
+	if hostname == "" {
+		if hostname, _ = os.Hostname(); hostname == "" {
+			hostname = "localhost"
+		}
+	}
+	if err = c.Hello(hostname); err != nil {
+		return err
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		cfg := s.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{ServerName: host}
+		}
+		if err = c.StartTLS(cfg); err != nil {
+			return err
+		}
+	} else if !s.SkipStartTLS {
+		return errors.New("smtp relay does not support STARTTLS")
+	}
+
+	if s.Username != "" {
+		var a smtp.Auth
+		if s.Auth == "login" {
+			a = &loginAuth{username: s.Username, password: s.Password, host: host}
+		} else {
+			a = smtp.PlainAuth("", s.Username, s.Password, host)
+		}
+		if err = c.Auth(a); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(job.From); err != nil {
+		return err
+	}
+	if err = c.Rcpt(job.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMessage builds the RFC 5322 message for the job. When both HTML and
+// Text are set they're sent as a multipart/alternative
+func buildMessage(job *Mail) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writeHeader(buf, "From", (&mail.Address{Name: job.FromName, Address: job.From}).String())
+	writeHeader(buf, "To", (&mail.Address{Name: job.ToName, Address: job.To}).String())
+	if job.ReplyTo != "" {
+		writeHeader(buf, "Reply-To", (&mail.Address{Address: job.ReplyTo}).String())
+	}
+	writeHeader(buf, "Subject", mime.QEncoding.Encode("utf-8", job.Subject))
+	writeHeader(buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(buf, "Message-ID", messageID(job.From))
+	writeHeader(buf, "MIME-Version", "1.0")
+
+	if len(job.UniqueArgs) > 0 {
+		// X-SMTPAPI is what SendGrid reads unique args from when relaying
+		// through their SMTP servers. Each pair is separated by a space so the
+		// header can be folded if it's too long
+		ks := make([]string, 0, len(job.UniqueArgs))
+		for k := range job.UniqueArgs {
+			ks = append(ks, k)
+		}
+		sort.Strings(ks)
+		pairs := make([]string, len(ks))
+		for i, k := range ks {
+			kb, _ := json.Marshal(k)
+			vb, _ := json.Marshal(job.UniqueArgs[k])
+			pairs[i] = string(kb) + ":" + string(vb)
+		}
+		writeHeader(buf, "X-SMTPAPI", `{"unique_args": {`+strings.Join(pairs, ", ")+"}}")
+	}
+
+	if job.HTML == "" || job.Text == "" {
+		var err error
+		if job.HTML != "" {
+			err = writePart(buf, nil, "text/html", job.HTML)
+		} else {
+			err = writePart(buf, nil, "text/plain", job.Text)
+		}
+		return buf.Bytes(), err
+	}
+
+	mw := multipart.NewWriter(buf)
+	writeHeader(buf, "Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{
+		"boundary": mw.Boundary(),
+	}))
+	buf.WriteString("\r\n")
+	// clients prefer the last part they understand, so html goes last
+	if err := writePart(buf, mw, "text/plain", job.Text); err != nil {
+		return nil, err
+	}
+	if err := writePart(buf, mw, "text/html", job.HTML); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writePart writes a quoted-printable body of the given type. If mw is nil
+// the part's headers are written directly to buf as the message's headers
+func writePart(buf *bytes.Buffer, mw *multipart.Writer, contentType, body string) error {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	var qw *quotedprintable.Writer
+	if mw == nil {
+		for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			writeHeader(buf, k, h.Get(k))
+		}
+		buf.WriteString("\r\n")
+		qw = quotedprintable.NewWriter(buf)
+	} else {
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		qw = quotedprintable.NewWriter(pw)
+	}
+	if _, err := qw.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// writeHeader writes the header to buf, folding it onto multiple lines at
+// spaces so that lines stay under the recommended 78 characters when possible
+func writeHeader(buf *bytes.Buffer, k, v string) {
+	// header values can't contain newlines
+	v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+	line := k + ":"
+	for i, w := range strings.Split(v, " ") {
+		if i > 0 && len(line)+len(w)+1 > 78 {
+			buf.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + w
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+// messageID generates a new random Message-ID using the domain of from
+func messageID(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain)
+}
+
+// loginAuth implements the LOGIN mechanism since net/smtp only has PLAIN and
+// CRAM-MD5
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// same restrictions as smtp.PlainAuth since the password is in plaintext
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
@@ -0,0 +1,247 @@
+package sender
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTP is a bare-bones SMTP server which records what it was sent. done is
+// closed once it's finished serving, and the recorded fields shouldn't be read
+// until then
+type fakeSMTP struct {
+	l        net.Listener
+	tlsCfg   *tls.Config
+	done     chan struct{}
+	auth     []string
+	from, to string
+	data     []byte
+	usedTLS  bool
+}
+
+func newFakeSMTP(t *T, tlsCfg *tls.Config) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	f := &fakeSMTP{l: l, tlsCfg: tlsCfg, done: make(chan struct{})}
+	go f.serve()
+	return f
+}
+
+func (f *fakeSMTP) serve() {
+	defer close(f.done)
+	conn, err := f.l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			if f.tlsCfg != nil && !f.usedTLS {
+				tc.PrintfLine("250-localhost\r\n250-STARTTLS\r\n250 AUTH PLAIN LOGIN")
+			} else {
+				tc.PrintfLine("250-localhost\r\n250 AUTH PLAIN LOGIN")
+			}
+		case "STARTTLS":
+			tc.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, f.tlsCfg)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			tc = textproto.NewConn(conn)
+			f.usedTLS = true
+		case "AUTH":
+			f.auth = strings.Split(line, " ")[1:]
+			if f.auth[0] == "LOGIN" {
+				for _, prompt := range []string{"Username:", "Password:"} {
+					tc.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+					l, _ := tc.ReadLine()
+					f.auth = append(f.auth, l)
+				}
+			}
+			tc.PrintfLine("235 ok")
+		case "MAIL":
+			f.from = line
+			tc.PrintfLine("250 ok")
+		case "RCPT":
+			f.to = line
+			tc.PrintfLine("250 ok")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			f.data, _ = tc.ReadDotBytes()
+			tc.PrintfLine("250 queued")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 unknown")
+		}
+	}
+}
+
+// wait blocks until the server is finished serving the connection
+func (f *fakeSMTP) wait(t *T) {
+	select {
+	case <-f.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for fake smtp server")
+	}
+}
+
+func (f *fakeSMTP) close() {
+	f.l.Close()
+}
+
+func testTLSConfig(t *T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSMTPSend(t *T) {
+	f := newFakeSMTP(t, nil)
+	defer f.close()
+
+	s := &SMTP{
+		Addr:         f.l.Addr().String(),
+		Username:     "user",
+		Password:     "pass",
+		Auth:         "plain",
+		SkipStartTLS: true,
+	}
+	require.Nil(t, s.Send(testMail()))
+	f.wait(t)
+
+	assert.Equal(t, "MAIL FROM:<from@test.com>", f.from)
+	assert.Equal(t, "RCPT TO:<to@test.com>", f.to)
+	require.Len(t, f.auth, 2)
+	assert.Equal(t, "PLAIN", f.auth[0])
+	b, _ := base64.StdEncoding.DecodeString(f.auth[1])
+	assert.Equal(t, "\x00user\x00pass", string(b))
+	assert.False(t, f.usedTLS)
+}
+
+func TestSMTPSendStartTLS(t *T) {
+	f := newFakeSMTP(t, testTLSConfig(t))
+	defer f.close()
+
+	s := &SMTP{
+		Addr:      f.l.Addr().String(),
+		Username:  "user",
+		Password:  "pass",
+		Auth:      "login",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	require.Nil(t, s.Send(testMail()))
+	f.wait(t)
+
+	assert.True(t, f.usedTLS)
+	require.Len(t, f.auth, 3)
+	assert.Equal(t, "LOGIN", f.auth[0])
+	u, _ := base64.StdEncoding.DecodeString(f.auth[1])
+	p, _ := base64.StdEncoding.DecodeString(f.auth[2])
+	assert.Equal(t, "user", string(u))
+	assert.Equal(t, "pass", string(p))
+	assert.NotEmpty(t, f.data)
+}
+
+func TestSMTPRequireStartTLS(t *T) {
+	f := newFakeSMTP(t, nil)
+	defer f.close()
+
+	s := &SMTP{Addr: f.l.Addr().String()}
+	assert.NotNil(t, s.Send(testMail()))
+}
+
+func TestBuildMessage(t *T) {
+	job := testMail()
+	job.Subject = "Héllo " + strings.Repeat("there ", 20)
+	b, err := buildMessage(job)
+	require.Nil(t, err)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	require.Nil(t, err)
+	dec := new(mime.WordDecoder)
+	subj, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	require.Nil(t, err)
+	assert.Equal(t, job.Subject, subj)
+	assert.Equal(t, `"<To>" <to@test.com>`, msg.Header.Get("To"))
+	assert.Equal(t, `"From" <from@test.com>`, msg.Header.Get("From"))
+	assert.Equal(t, "<reply@test.com>", msg.Header.Get("Reply-To"))
+	assert.Equal(t, `{"unique_args": {"pmStatsID":"abc"}}`, msg.Header.Get("X-SMTPAPI"))
+	assert.True(t, strings.HasSuffix(msg.Header.Get("Message-ID"), "@test.com>"))
+	for _, l := range strings.Split(string(b), "\r\n") {
+		assert.True(t, len(l) <= 998)
+	}
+
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	assert.Equal(t, "multipart/alternative", mt)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+
+	p, err := mr.NextPart()
+	require.Nil(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", p.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(p)
+	assert.Equal(t, job.Text, string(body))
+
+	p, err = mr.NextPart()
+	require.Nil(t, err)
+	assert.Equal(t, "text/html; charset=utf-8", p.Header.Get("Content-Type"))
+	body, _ = ioutil.ReadAll(p)
+	assert.Equal(t, job.HTML, string(body))
+
+	// only text
+	job.HTML = ""
+	b, err = buildMessage(job)
+	require.Nil(t, err)
+	msg, err = mail.ReadMessage(bufio.NewReader(bytes.NewReader(b)))
+	require.Nil(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", msg.Header.Get("Content-Type"))
+	body, _ = ioutil.ReadAll(msg.Body)
+	assert.Equal(t, job.Text, string(body))
+}
+
+func TestSMTPError(t *T) {
+	err := smtpError(&textproto.Error{Code: 550, Msg: "no such user"})
+	assert.True(t, IsPermanent(err))
+	assert.Equal(t, "smtp returned 550: no such user", err.Error())
+
+	assert.False(t, IsPermanent(smtpError(&textproto.Error{Code: 451, Msg: "try again"})))
+	assert.False(t, IsPermanent(smtpError(&textproto.Error{Code: 535, Msg: "bad auth"})))
+	assert.Nil(t, smtpError(nil))
+}
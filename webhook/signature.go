@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The headers SendGrid sends the signature of a signed event webhook in
+const (
+	signatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	timestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+var (
+	// verificationKey is set by --webhook-verification-key. When it's set
+	// every webhook request must be signed with it
+	verificationKey *ecdsa.PublicKey
+
+	// timestampTolerance is how far a signed request's timestamp can be from
+	// now, so captured requests can't be replayed later
+	timestampTolerance = 5 * time.Minute
+
+	errSignatureMissing = errors.New("signature missing")
+	errSignatureInvalid = errors.New("signature invalid")
+	errTimestampInvalid = errors.New("timestamp invalid or outside tolerance")
+)
+
+// parseVerificationKey parses the verification key shown in SendGrid's mail
+// settings, which is a base64 encoded ECDSA public key. PEM encoded keys are
+// accepted too
+func parseVerificationKey(s string) (*ecdsa.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	var der []byte
+	if b, _ := pem.Decode([]byte(s)); b != nil {
+		der = b.Bytes
+	} else {
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, err
+		}
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("verification key is not an ECDSA public key")
+	}
+	return key, nil
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// verifySignature verifies that body was signed with key, using the signature
+// and timestamp SendGrid sent in the headers. The signature is of the
+// timestamp followed by the body
+func verifySignature(key *ecdsa.PublicKey, sig, timestamp string, body []byte, now time.Time) error {
+	if sig == "" || timestamp == "" {
+		return errSignatureMissing
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errTimestampInvalid
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > timestampTolerance || d < -timestampTolerance {
+		return errTimestampInvalid
+	}
+	sigb, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	var es ecdsaSignature
+	if rest, err := asn1.Unmarshal(sigb, &es); err != nil || len(rest) > 0 {
+		return errSignatureInvalid
+	}
+	if es.R == nil || es.S == nil || es.R.Sign() <= 0 || es.S.Sign() <= 0 {
+		return errSignatureInvalid
+	}
+	h := sha256.New()
+	h.Write([]byte(timestamp))
+	h.Write(body)
+	if !ecdsa.Verify(key, h.Sum(nil), es.R, es.S) {
+		return errSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	. "testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(t *T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	return key
+}
+
+func sign(t *T, key *ecdsa.PrivateKey, timestamp string, body []byte) string {
+	h := sha256.Sum256(append([]byte(timestamp), body...))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	require.Nil(t, err)
+	sig, err := asn1.Marshal(ecdsaSignature{r, s})
+	require.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestParseVerificationKey(t *T) {
+	key := testKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+
+	pub, err := parseVerificationKey(base64.StdEncoding.EncodeToString(der))
+	require.Nil(t, err)
+	assert.Equal(t, key.PublicKey.X, pub.X)
+	assert.Equal(t, key.PublicKey.Y, pub.Y)
+
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	pub, err = parseVerificationKey(string(pemKey))
+	require.Nil(t, err)
+	assert.Equal(t, key.PublicKey.X, pub.X)
+	assert.Equal(t, key.PublicKey.Y, pub.Y)
+
+	_, err = parseVerificationKey("notakey")
+	assert.NotNil(t, err)
+}
+
+func TestVerifySignature(t *T) {
+	key := testKey(t)
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	body := []byte(`[{"event":"open"}]`)
+	sig := sign(t, key, ts, body)
+
+	assert.Nil(t, verifySignature(&key.PublicKey, sig, ts, body, now))
+
+	// tampered body
+	assert.Equal(t, errSignatureInvalid, verifySignature(&key.PublicKey, sig, ts, []byte(`[{"event":"click"}]`), now))
+	// tampered timestamp
+	ts2 := strconv.FormatInt(now.Unix()+1, 10)
+	assert.Equal(t, errSignatureInvalid, verifySignature(&key.PublicKey, sig, ts2, body, now))
+	// signed by a different key
+	assert.Equal(t, errSignatureInvalid, verifySignature(&testKey(t).PublicKey, sig, ts, body, now))
+	// replayed after the tolerance
+	assert.Equal(t, errTimestampInvalid, verifySignature(&key.PublicKey, sig, ts, body, now.Add(timestampTolerance+time.Second)))
+	// unsigned
+	assert.Equal(t, errSignatureMissing, verifySignature(&key.PublicKey, "", "", body, now))
+	assert.Equal(t, errSignatureInvalid, verifySignature(&key.PublicKey, "!!", ts, body, now))
+}
+
+func TestHookHandlerSigned(t *T) {
+	webhookPassword = ""
+	key := testKey(t)
+	verificationKey = &key.PublicKey
+	defer func() { verificationKey = nil }()
+
+	body := []byte(`[{"email":"webhooktest@test","timestamp":1,"event":"test","pmStatsID":"s"}]`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req := func(sig string, body []byte) int {
+		r, _ := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+		r.Header.Set("Content-Type", "application/json")
+		if sig != "" {
+			r.Header.Set(signatureHeader, sig)
+			r.Header.Set(timestampHeader, ts)
+		}
+		w := httptest.NewRecorder()
+		hookHandler(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, req(sign(t, key, ts, body), body))
+	assert.Equal(t, 401, req("", body))
+	tampered := bytes.Replace(body, []byte("test"), []byte("open"), 1)
+	assert.Equal(t, 401, req(sign(t, key, ts, body), tampered))
+}
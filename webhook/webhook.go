@@ -1,7 +1,9 @@
 package webhook
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"time"
 
@@ -14,6 +16,9 @@ import (
 
 var webhookPassword string
 
+// maxBodySize is the largest webhook request body that's read
+const maxBodySize = 10 << 20
+
 // WebhookEvent is just a wrapper around db.StatsJob for now
 // it holds a representation of an incoming webhook event
 type WebhookEvent db.StatsJob
@@ -25,6 +30,16 @@ func init() {
 			return
 		}
 		webhookPassword, _ = g.ParamStr("--webhook-pass")
+		var err error
+		if key, _ := g.ParamStr("--webhook-verification-key"); key != "" {
+			if verificationKey, err = parseVerificationKey(key); err != nil {
+				llog.Fatal("invalid --webhook-verification-key", llog.ErrKV(err))
+			}
+		}
+		tolerance, _ := g.ParamStr("--webhook-timestamp-tolerance")
+		if timestampTolerance, err = time.ParseDuration(tolerance); err != nil {
+			llog.Fatal("invalid --webhook-timestamp-tolerance", llog.ErrKV(err))
+		}
 
 		go func() {
 			s := &http.Server{
@@ -54,16 +69,33 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 
 	if webhookPassword != "" {
 		_, password, authOk := r.BasicAuth()
-		if !authOk || password != webhookPassword {
+		// compare in constant time so the password can't be guessed by timing
+		// the responses
+		if !authOk || subtle.ConstantTimeCompare([]byte(password), []byte(webhookPassword)) != 1 {
 			llog.Warn("webhook authorization failed", kv)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 	}
 
-	decoder := json.NewDecoder(r.Body)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		llog.Warn("webhook failed to read body", kv, llog.ErrKV(err))
+		http.Error(w, "Invalid POST Body", http.StatusBadRequest)
+		return
+	}
+
+	if verificationKey != nil {
+		sig, ts := r.Header.Get(signatureHeader), r.Header.Get(timestampHeader)
+		if err := verifySignature(verificationKey, sig, ts, body, time.Now()); err != nil {
+			llog.Warn("webhook signature verification failed", kv, llog.ErrKV(err))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
 	var events []WebhookEvent
-	err := decoder.Decode(&events)
+	err = json.Unmarshal(body, &events)
 	if err != nil || len(events) == 0 {
 		llog.Warn("webhook failed to parse body", kv, llog.ErrKV(err))
 		http.Error(w, "Invalid POST Body", http.StatusBadRequest)
@@ -86,6 +118,7 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 		if event.StatsID == "" && event.OldStatsID != "" {
 			event.StatsID = event.OldStatsID
 		}
+		(*db.StatsJob)(&event).Truncate()
 		if err := validator.Validate(event); err != nil {
 			llog.Warn("webhook event failed validation", kv, llog.ErrKV(err))
 			continue
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	. "testing"
 
+	"github.com/levenlabs/golib/testutil"
 	"github.com/levenlabs/postmaster/db"
 	"github.com/levenlabs/postmaster/ga"
 	"github.com/stretchr/testify/assert"
@@ -33,6 +34,20 @@ func TestHookHandlerPassword(t *T) {
 	assert.Equal(t, 200, w.Code)
 }
 
+func TestHookHandlerWrongPassword(t *T) {
+	webhookPassword = "test"
+	defer func() { webhookPassword = "" }()
+
+	str := []byte(`[{"email":"webhooktest@test","timestamp":1,"event":"test","pmStatsID":"s"}]`)
+	r, _ := http.NewRequest("POST", "/", bytes.NewBuffer(str))
+	r.Header.Set("Content-Type", "application/json")
+	r.SetBasicAuth("anything", "tes")
+	w := httptest.NewRecorder()
+
+	hookHandler(w, r)
+	assert.Equal(t, 401, w.Code)
+}
+
 func TestHookHandlerOpen(t *T) {
 	webhookPassword = ""
 
@@ -47,7 +62,7 @@ func TestHookHandlerOpen(t *T) {
 
 	doc, err := db.GetStats(id)
 	require.Nil(t, err)
-	assert.Equal(t, int64(db.Opened), doc.StateFlags)
+	assert.Equal(t, int64(db.Opened|db.Delivered|db.Processed), doc.StateFlags)
 }
 
 func TestHookHandlerDelivered(t *T) {
@@ -64,7 +79,7 @@ func TestHookHandlerDelivered(t *T) {
 
 	doc, err := db.GetStats(id)
 	require.Nil(t, err)
-	assert.Equal(t, int64(db.Delivered), doc.StateFlags)
+	assert.Equal(t, int64(db.Delivered|db.Processed), doc.StateFlags)
 }
 
 func TestHookHandlerDropped(t *T) {
@@ -99,8 +114,28 @@ func TestHookHandlerBounced(t *T) {
 
 	doc, err := db.GetStats(id)
 	require.Nil(t, err)
-	assert.Equal(t, int64(db.Bounced), doc.StateFlags)
+	assert.Equal(t, int64(db.Bounced|db.Processed), doc.StateFlags)
 	assert.Equal(t, "Test", doc.Error)
+	// bounces which can't be classified are assumed to be hard
+	require.NotNil(t, doc.Bounce)
+	assert.Equal(t, db.BounceHard, doc.Bounce.Class)
+}
+
+func TestHookHandlerBouncedClassified(t *T) {
+	webhookPassword = ""
+
+	id := db.GenerateEmailID("webhooktest@test.com", 0, "", "production")
+	str := []byte(fmt.Sprintf(`[{"email":"webhooktest@test","timestamp":1449264108,"pmStatsID":"%s","pmEnvID":"production","event":"bounce","type":"bounce","reason":"452 4.2.2 Mailbox full"}]`, id))
+	r, _ := http.NewRequest("POST", "/", bytes.NewBuffer(str))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	hookHandler(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	doc, err := db.GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, &db.Bounce{Class: db.BounceSoft, Code: 452, Status: "4.2.2"}, doc.Bounce)
 }
 
 func TestHookHandlerSpamReport(t *T) {
@@ -117,7 +152,7 @@ func TestHookHandlerSpamReport(t *T) {
 
 	doc, err := db.GetStats(id)
 	require.Nil(t, err)
-	assert.Equal(t, int64(db.SpamReported), doc.StateFlags)
+	assert.Equal(t, int64(db.SpamReported|db.Delivered|db.Processed), doc.StateFlags)
 }
 
 func TestHookHandlerDeliveredMultiple(t *T) {
@@ -138,11 +173,11 @@ func TestHookHandlerDeliveredMultiple(t *T) {
 
 	doc, err := db.GetStats(id)
 	require.Nil(t, err)
-	assert.Equal(t, int64(db.Delivered), doc.StateFlags)
+	assert.Equal(t, int64(db.Delivered|db.Processed), doc.StateFlags)
 
 	doc, err = db.GetStats(id)
 	require.Nil(t, err)
-	assert.Equal(t, int64(db.Delivered), doc.StateFlags)
+	assert.Equal(t, int64(db.Delivered|db.Processed), doc.StateFlags)
 }
 
 func TestHookHandlerDev(t *T) {
@@ -161,3 +196,88 @@ func TestHookHandlerDev(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, int64(0), doc.StateFlags)
 }
+
+func TestHookHandlerEvents(t *T) {
+	webhookPassword = ""
+
+	tests := []struct {
+		event  string
+		reason string
+		state  int
+	}{
+		{"click", "", db.Clicked | db.Opened | db.Delivered | db.Processed},
+		{"processed", "", db.Processed},
+		{"deferred", "421 4.7.0 Try again later", db.Deferred | db.Processed},
+	}
+	for _, test := range tests {
+		id := db.GenerateEmailID(testEmail, 0, "", "production")
+		str := []byte(fmt.Sprintf(`[{"email":"webhooktest@test","timestamp":1449264108,"pmStatsID":"%s","pmEnvID":"production","event":"%s","reason":"%s"}]`, id, test.event, test.reason))
+		r, _ := http.NewRequest("POST", "/", bytes.NewBuffer(str))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		hookHandler(w, r)
+		assert.Equal(t, 200, w.Code)
+
+		doc, err := db.GetStats(id)
+		require.Nil(t, err)
+		assert.Equal(t, int64(test.state), doc.StateFlags, test.event)
+		assert.Equal(t, test.reason, doc.Error, test.event)
+	}
+}
+
+func TestHookHandlerEventHistory(t *T) {
+	webhookPassword = ""
+
+	id := db.GenerateEmailID(testEmail, 0, "", "production")
+	str := []byte(fmt.Sprintf(`[
+	{"email":"webhooktest@test","timestamp":1449264108,"pmStatsID":"%s","pmEnvID":"production","event":"delivered"},
+	{"email":"webhooktest@test","timestamp":1449264109,"pmStatsID":"%s","pmEnvID":"production","event":"open","ip":"1.2.3.4","useragent":"Mozilla/5.0"},
+	{"email":"webhooktest@test","timestamp":1449264110,"pmStatsID":"%s","pmEnvID":"production","event":"open","ip":"1.2.3.4","useragent":"Mozilla/5.0"},
+	{"email":"webhooktest@test","timestamp":1449264111,"pmStatsID":"%s","pmEnvID":"production","event":"click","url":"https://test.com"}
+	]`, id, id, id, id))
+	r, _ := http.NewRequest("POST", "/", bytes.NewBuffer(str))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	hookHandler(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	events, err := db.GetStatEvents(id)
+	require.Nil(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, "delivered", events[0].Type)
+	assert.Equal(t, "open", events[1].Type)
+	assert.Equal(t, "1.2.3.4", events[1].IP)
+	assert.Equal(t, "Mozilla/5.0", events[1].UserAgent)
+	assert.Equal(t, "open", events[2].Type)
+	assert.Equal(t, "click", events[3].Type)
+	assert.Equal(t, "https://test.com", events[3].URL)
+
+	doc, err := db.GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(db.Delivered|db.Opened|db.Clicked|db.Processed), doc.StateFlags)
+}
+
+func TestHookHandlerUnsubscribe(t *T) {
+	webhookPassword = ""
+
+	email := testutil.RandStr() + "@test.com"
+	require.Nil(t, db.StoreEmailFlags(email, 2))
+	id := db.GenerateEmailID(email, 4|8, "", "production")
+	str := []byte(fmt.Sprintf(`[{"email":"%s","timestamp":1449264108,"pmStatsID":"%s","pmEnvID":"production","event":"unsubscribe"}]`, email, id))
+	r, _ := http.NewRequest("POST", "/", bytes.NewBuffer(str))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	hookHandler(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	doc, err := db.GetStats(id)
+	require.Nil(t, err)
+	assert.Equal(t, int64(db.Unsubscribed|db.Delivered|db.Processed), doc.StateFlags)
+
+	flags, err := db.GetEmailFlags(email)
+	require.Nil(t, err)
+	assert.Equal(t, int64(2|4|8), flags)
+}